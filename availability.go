@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = time.Minute
+	defaultMissedHeartbeats  = 3
+)
+
+// Availability states as published
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+// nodeAvailability tracks the heartbeats of the nodes; a node is offline
+// once its heartbeat has not arrived for a number of intervals. The known
+// nodes are tracked from the start, so a node that was left online by a
+// previous run is marked offline when it stays silent.
+type nodeAvailability struct {
+	timeout  time.Duration
+	lastSeen map[string]time.Time
+	status   map[string]string
+}
+
+func newNodeAvailability(c availabilityConfig) *nodeAvailability {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+
+	missed := c.Missed
+	if missed <= 0 {
+		missed = defaultMissedHeartbeats
+	}
+
+	a := &nodeAvailability{
+		timeout:  interval * time.Duration(missed),
+		lastSeen: map[string]time.Time{},
+		status:   map[string]string{},
+	}
+
+	now := time.Now()
+
+	for _, node := range knownNodes() {
+		a.lastSeen[node] = now
+	}
+
+	return a
+}
+
+// Heartbeat records a heartbeat of the node, and tells whether the node just
+// came online; heartbeats that are too old to count (eg. when replayed) are
+// ignored
+func (a *nodeAvailability) Heartbeat(node string, at time.Time) bool {
+	if time.Since(at) > a.timeout {
+		return false
+	}
+
+	if at.After(a.lastSeen[node]) {
+		a.lastSeen[node] = at
+	}
+
+	if a.status[node] == availabilityOnline {
+		return false
+	}
+
+	a.status[node] = availabilityOnline
+
+	return true
+}
+
+// Expire returns the nodes that went offline since the last call
+func (a *nodeAvailability) Expire(now time.Time) []string {
+	var nodes []string
+
+	for node, seen := range a.lastSeen {
+		if a.status[node] != availabilityOffline && now.Sub(seen) > a.timeout {
+			a.status[node] = availabilityOffline
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// knownNodes returns the nodes of the sensors in the configuration
+func knownNodes() []string {
+	seen := map[string]bool{}
+
+	add := func(node string) {
+		if node != "" {
+			seen[node] = true
+		}
+	}
+
+	for i := range cfg.Receivers {
+		rc := &cfg.Receivers[i]
+
+		for id := range cfg.NameMapping {
+			add(nodeFor(rc, id))
+		}
+
+		for id := range rc.NameMapping {
+			add(nodeFor(rc, id))
+		}
+	}
+
+	for _, sc := range cfg.Sensors {
+		add(sc.Node)
+	}
+
+	nodes := []string{}
+	for node := range seen {
+		nodes = append(nodes, node)
+	}
+
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// heartbeatNode returns the node a heartbeat belongs to, or "" when the
+// metric is not a heartbeat
+func heartbeatNode(m *Metric) string {
+	if m.Type != "heartbeat" {
+		return ""
+	}
+
+	switch {
+	case m.Node != "":
+		return m.Node
+	case m.Name != "":
+		return m.Name
+	default:
+		return m.ID
+	}
+}
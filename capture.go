@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureWriter appends every line read from the receivers to a file, which
+// is rotated by size and age; rotated segments are optionally gzipped
+type captureWriter struct {
+	sync.Mutex
+	config      captureConfig
+	file        *os.File
+	size        int64
+	opened      time.Time
+	closed      bool
+	compressing sync.WaitGroup
+}
+
+var capture *captureWriter
+
+func newCaptureWriter(c captureConfig) (*captureWriter, error) {
+	if c.MaxSize < 0 || c.MaxAge < 0 {
+		return nil, fmt.Errorf("max_size and max_age can not be negative")
+	}
+
+	w := &captureWriter{config: c}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *captureWriter) open() error {
+	f, err := os.OpenFile(w.config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	w.opened = time.Now()
+
+	// Appending to an earlier file continues its age, or restarting would
+	// postpone the rotation every time
+	if w.size > 0 {
+		w.opened = firstRecordTime(w.config.Path, info.ModTime())
+	}
+
+	return nil
+}
+
+// firstRecordTime returns the time of the first record in a capture file,
+// or the fallback when it can not be read
+func firstRecordTime(name string, fallback time.Time) time.Time {
+	f, err := os.Open(name)
+	if err != nil {
+		return fallback
+	}
+	defer f.Close()
+
+	record, err := bufio.NewReader(f).ReadString(' ')
+	if err != nil {
+		return fallback
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, strings.TrimSuffix(record, " "))
+	if err != nil {
+		return fallback
+	}
+
+	return at
+}
+
+// Close closes the capture file, after the rotated segments were compressed
+func (w *captureWriter) Close() {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+
+	w.closed = true
+
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			log.Errorf("Could not close capture file '%s': %s", w.config.Path, err)
+		}
+
+		w.file = nil
+	}
+
+	w.Unlock()
+
+	w.compressing.Wait()
+}
+
+// Write records a line; it does nothing when capturing is not enabled
+func (w *captureWriter) Write(receiver string, at time.Time, text string) {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	record := fmt.Sprintf("%s %s %s\n", at.Format(time.RFC3339Nano), receiver, text)
+
+	if w.needsRotation(at, len(record)) {
+		if err := w.rotate(at); err != nil {
+			stats.Inc("capture.errors")
+			log.Errorf("Could not rotate capture file '%s': %s", w.config.Path, err)
+		}
+	}
+
+	if w.file == nil {
+		return
+	}
+
+	n, err := w.file.WriteString(record)
+	w.size += int64(n)
+
+	if err != nil {
+		stats.Inc("capture.errors")
+		log.Errorf("Could not write to capture file '%s': %s", w.config.Path, err)
+	}
+}
+
+func (w *captureWriter) needsRotation(at time.Time, size int) bool {
+	if w.file == nil {
+		return true
+	}
+
+	if w.config.MaxSize > 0 && w.size > 0 && w.size+int64(size) > w.config.MaxSize {
+		return true
+	}
+
+	return w.config.MaxAge > 0 && at.Sub(w.opened) > w.config.MaxAge
+}
+
+func (w *captureWriter) rotate(at time.Time) error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+
+		w.file = nil
+
+		segment := w.config.Path + "." + at.Format("20060102-150405.000000")
+		if err := os.Rename(w.config.Path, segment); err != nil {
+			return err
+		}
+
+		if w.config.Compress {
+			w.compressing.Add(1)
+
+			go func() {
+				defer w.compressing.Done()
+				compressSegment(segment)
+			}()
+		}
+	}
+
+	return w.open()
+}
+
+func compressSegment(segment string) {
+	if err := gzipFile(segment); err != nil {
+		stats.Inc("capture.errors")
+		log.Errorf("Could not compress capture file '%s': %s", segment, err)
+	}
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
@@ -1,33 +1,154 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type config struct {
-	Receiver struct {
-		PortStr  string `yaml:"port_str"`
-		BaudRate int    `yaml:"baud_rate"`
-		DataBits int    `yaml:"data_bits"`
-		StopBits int    `yaml:"stop_bits"`
-		Parity   int    `yaml:"parity"`
-	} `yaml:"receiver"`
-	Graphite struct {
+	Receiver    receiverConfig   `yaml:"receiver"`
+	Receivers   []receiverConfig `yaml:"receivers"`
+	Deduplicate time.Duration    `yaml:"deduplicate"`
+	Capture     captureConfig    `yaml:"capture"`
+	Graphite    struct {
 		Configuration struct {
-			Host   string `yaml:"host"`
-			Port   int    `yaml:"port"`
-			Prefix string `yaml:"prefix"`
+			Host     string        `yaml:"host"`
+			Port     int           `yaml:"port"`
+			Prefix   string        `yaml:"prefix"`
+			Protocol string        `yaml:"protocol"`
+			Timeout  time.Duration `yaml:"timeout"`
+			Template string        `yaml:"template"`
+			Tags     bool          `yaml:"tags"`
 		} `yaml:"configuration"`
 	} `yaml:"graphite"`
 	MQTT struct {
-		Host        string `yaml:"host"`
-		Username    string `yaml:"username"`
-		Password    string `yaml:"password"`
-		TopicPrefix string `yaml:"topic_prefix"`
+		Host            string             `yaml:"host"`
+		Username        string             `yaml:"username"`
+		Password        string             `yaml:"password"`
+		TopicPrefix     string             `yaml:"topic_prefix"`
+		ClientID        string             `yaml:"client_id"`
+		ClientIDSuffix  string             `yaml:"client_id_suffix"`
+		CleanSession    *bool              `yaml:"clean_session"`
+		KeepAlive       time.Duration      `yaml:"keepalive"`
+		PingTimeout     time.Duration      `yaml:"ping_timeout"`
+		TLS             tlsConfig          `yaml:"tls"`
+		QoS             int                `yaml:"qos"`
+		Retain          *bool              `yaml:"retain"`
+		Payload         string             `yaml:"payload"`
+		PayloadTemplate string             `yaml:"payload_template"`
+		TopicTemplate   string             `yaml:"topic_template"`
+		Rules           []mqttRuleConfig   `yaml:"rules"`
+		Availability    availabilityConfig `yaml:"availability"`
+		Discovery       discoveryConfig    `yaml:"discovery"`
 	} `yaml:"mqtt"`
+	Sinks       []string                `yaml:"sinks"`
+	Queues      map[string]queueConfig  `yaml:"queues"`
+	NameMapping map[string]string       `yaml:"name_mapping"`
+	Sensors     map[string]sensorConfig `yaml:"sensors"`
+	Stats       statsConfig             `yaml:"stats"`
+}
+
+type receiverConfig struct {
+	Name        string            `yaml:"name"`
+	NamePrefix  string            `yaml:"name_prefix"`
 	NameMapping map[string]string `yaml:"name_mapping"`
+	Type        string            `yaml:"type"`
+	Address     string            `yaml:"address"`
+	PortStr     string            `yaml:"port_str"`
+	BaudRate    int               `yaml:"baud_rate"`
+	DataBits    int               `yaml:"data_bits"`
+	StopBits    int               `yaml:"stop_bits"`
+	Parity      int               `yaml:"parity"`
+	ReadTimeout time.Duration     `yaml:"read_timeout"`
+	Path        string            `yaml:"path"`
+	Format      string            `yaml:"format"`
+	Speed       float64           `yaml:"speed"`
+	Simulation  simulationConfig  `yaml:"simulation"`
+}
+
+type simulationConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Corrupt  float64       `yaml:"corrupt"`
+	Dropout  float64       `yaml:"dropout"`
+	Nodes    []struct {
+		ID      string   `yaml:"id"`
+		Sensors []string `yaml:"sensors"`
+	} `yaml:"nodes"`
+}
+
+type queueConfig struct {
+	Size       int           `yaml:"size"`
+	Overflow   string        `yaml:"overflow"`
+	Directory  string        `yaml:"directory"`
+	Persistent bool          `yaml:"persistent"`
+	MaxSize    int64         `yaml:"max_size"`
+	MaxAge     time.Duration `yaml:"max_age"`
+
+	BatchSize     int           `yaml:"batch_size"`
+	BatchInterval time.Duration `yaml:"batch_interval"`
+}
+
+type captureConfig struct {
+	Path     string        `yaml:"path"`
+	MaxSize  int64         `yaml:"max_size"`
+	MaxAge   time.Duration `yaml:"max_age"`
+	Compress bool          `yaml:"compress"`
+}
+
+type mqttRuleConfig struct {
+	Match           string `yaml:"match"`
+	QoS             *int   `yaml:"qos"`
+	Retain          *bool  `yaml:"retain"`
+	Payload         string `yaml:"payload"`
+	PayloadTemplate string `yaml:"payload_template"`
+}
+
+type availabilityConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Missed   int           `yaml:"missed"`
+}
+
+type discoveryConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Prefix  string `yaml:"prefix"`
+}
+
+type tlsConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type sensorConfig struct {
+	Node          string  `yaml:"node"`
+	Humidity      string  `yaml:"humidity"`
+	SenseResistor float64 `yaml:"sense_resistor"`
+}
+
+type statsConfig struct {
+	Name     string        `yaml:"name"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (s statsConfig) name() string {
+	if s.Name == "" {
+		return "onewire"
+	}
+
+	return s.Name
+}
+
+func (s statsConfig) interval() time.Duration {
+	if s.Interval <= 0 {
+		return time.Minute
+	}
+
+	return s.Interval
 }
 
 func readConfiguration(filename string) error {
@@ -41,9 +162,77 @@ func readConfiguration(filename string) error {
 		return err
 	}
 
+	// A single receiver can still be configured the old way
+	if len(cfg.Receivers) == 0 {
+		cfg.Receivers = []receiverConfig{cfg.Receiver}
+	}
+
+	names := map[string]bool{}
+
+	for i := range cfg.Receivers {
+		rc := &cfg.Receivers[i]
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("receiver%d", i+1)
+		}
+
+		if names[rc.Name] {
+			return fmt.Errorf("receiver name '%s' is used more than once", rc.Name)
+		}
+
+		names[rc.Name] = true
+	}
+
 	return nil
 }
 
-func idToName(id string) string {
+// mappedName maps the id to a name, using the receiver's own mapping before
+// the global one
+func mappedName(rc *receiverConfig, id string) string {
+	if name, ok := rc.NameMapping[id]; ok {
+		return name
+	}
+
 	return cfg.NameMapping[id]
 }
+
+// idToName maps the id to a name, prefixed with the receiver's name prefix
+func idToName(rc *receiverConfig, id string) string {
+	name := mappedName(rc, id)
+
+	if rc.NamePrefix == "" || name == "" {
+		return name
+	}
+
+	return rc.NamePrefix + "." + name
+}
+
+// nodeFor returns the node a sensor belongs to: as configured for the
+// sensor, or else the first part of its mapped name
+func nodeFor(rc *receiverConfig, id string) string {
+	if node := sensorConfigFor(id).Node; node != "" {
+		return node
+	}
+
+	name := mappedName(rc, id)
+
+	if i := strings.Index(name, "."); i > 0 {
+		return name[:i]
+	}
+
+	return ""
+}
+
+// receiverByName returns the configuration of the named receiver, or nil
+func receiverByName(name string) *receiverConfig {
+	for i := range cfg.Receivers {
+		if cfg.Receivers[i].Name == name {
+			return &cfg.Receivers[i]
+		}
+	}
+
+	return nil
+}
+
+func sensorConfigFor(id string) sensorConfig {
+	return cfg.Sensors[id]
+}
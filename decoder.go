@@ -0,0 +1,129 @@
+package main
+
+import "fmt"
+
+type decodeFunc func(f *frame) ([]*Metric, error)
+
+type decoder struct {
+	Name       string
+	MinPayload int
+	Decode     decodeFunc
+}
+
+var decoders = map[int]*decoder{}
+
+func registerDecoder(family int, name string, minPayload int, decode decodeFunc) {
+	if _, ok := decoders[family]; ok {
+		panic(fmt.Sprintf("decoder for family 0x%02x registered twice", family))
+	}
+
+	decoders[family] = &decoder{Name: name, MinPayload: minPayload, Decode: decode}
+}
+
+func init() {
+	registerDecoder(familyNode, "node", 1, payloadNode)
+	registerDecoder(0x10, "DS18S20", 2, payloadDS18S20)
+	registerDecoder(0x1d, "DS2423", ds2423CounterSize, payloadDS2423)
+	registerDecoder(0x26, "DS2438", ds2438ScratchpadSize, payloadDS2438)
+	registerDecoder(0x28, "DS18B20", 2, payloadDS18B20)
+	registerDecoder(0x29, "DS2408", 1, payloadDS2408)
+	registerDecoder(0x3a, "DS2413", 1, payloadDS2413)
+}
+
+func decodePayload(f *frame) ([]*Metric, error) {
+	d, ok := decoders[f.Family]
+	if !ok {
+		return payloadUnknown(f)
+	}
+
+	return d.Decode(f)
+}
+
+func payloadUnknown(f *frame) ([]*Metric, error) {
+	return []*Metric{{Type: "unknown", Raw: hexString(f.Payload), Undecoded: true}}, nil
+}
+
+func payloadNode(f *frame) ([]*Metric, error) {
+	payload := f.Payload
+
+	payloadTypeInt := payload[0]
+	payloadType := "unknown"
+
+	if payloadTypeInt == 1 {
+		payloadType = "heartbeat"
+	}
+
+	payloadValue := 0
+
+	for i := len(payload) - 1; i >= 1; i-- {
+		payloadValue = payloadValue<<8 + payload[i]
+	}
+
+	return []*Metric{{Type: payloadType, Value: float64(payloadValue)}}, nil
+}
+
+const (
+	ds18b20ScratchpadSize = 9
+
+	// Raw readings for the power-on reset value (85°C) and the value some
+	// masters report for a disconnected sensor (-127°C)
+	ds18b20PowerOnReset = 0x0550
+	ds18b20Disconnected = 0xf810
+)
+
+func payloadDS18B20(f *frame) ([]*Metric, error) {
+	payload := f.Payload
+
+	low := payload[0]
+	high := payload[1]
+
+	high = high << 8
+	t := high + low
+
+	if t == ds18b20PowerOnReset || t == ds18b20Disconnected {
+		return nil, rejectFrame("sentinel", "DS18B20 '%s' reported sentinel value 0x%04x", f.ID, t)
+	}
+
+	if len(payload) >= ds18b20ScratchpadSize {
+		if crc8(payload[:ds18b20ScratchpadSize-1]) != payload[ds18b20ScratchpadSize-1] {
+			return nil, rejectFrame("crc", "DS18B20 '%s' scratchpad CRC mismatch", f.ID)
+		}
+
+		// Bits 5 and 6 of the configuration register set the resolution to
+		// 9 to 12 bit; the undefined least significant bits are masked
+		resolution := (payload[4] >> 5) & 0x03
+		t &^= (1 << (3 - resolution)) - 1
+	}
+
+	sign := t & 32768
+
+	var s int
+	if sign == 0 {
+		s = 1
+	} else {
+		s = -1
+		t = (t ^ 65535) + 1
+	}
+
+	temp := float64(s*t) / 16.0
+
+	return []*Metric{{Type: "temperature", Value: temp}}, nil
+}
+
+func payloadDS18S20(f *frame) ([]*Metric, error) {
+	payload := f.Payload
+
+	t := int(int16(payload[1]<<8 | payload[0]))
+
+	if len(payload) < 8 || payload[7] == 0 {
+		// No COUNT_REMAIN/COUNT_PER_C available, fall back to 0.5°C resolution
+		return []*Metric{{Type: "temperature", Value: float64(t) / 2.0}}, nil
+	}
+
+	countRemain := float64(payload[6])
+	countPerC := float64(payload[7])
+
+	temp := float64(t>>1) - 0.25 + (countPerC-countRemain)/countPerC
+
+	return []*Metric{{Type: "temperature", Value: temp}}, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+type seenFrame struct {
+	Receiver string
+	At       time.Time
+}
+
+var seenFrames = map[string]seenFrame{}
+
+// isDuplicate tells whether another receiver passed the same frame within
+// the deduplication window; it is always false when deduplication is off
+func isDuplicate(receiver string, f *frame) bool {
+	if cfg.Deduplicate <= 0 {
+		return false
+	}
+
+	now := time.Now()
+
+	for k, s := range seenFrames {
+		if now.Sub(s.At) > cfg.Deduplicate {
+			delete(seenFrames, k)
+		}
+	}
+
+	key := f.ID + ":" + hexString(f.Payload)
+
+	if s, ok := seenFrames[key]; ok && s.Receiver != receiver {
+		return true
+	}
+
+	seenFrames[key] = seenFrame{Receiver: receiver, At: now}
+
+	return false
+}
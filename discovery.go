@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultDiscoveryPrefix = "homeassistant"
+
+// Characters Home Assistant does not allow in a discovery topic
+var discoveryInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// discoveryClass is how Home Assistant should present a metric type
+type discoveryClass struct {
+	DeviceClass string
+	Unit        string
+	StateClass  string
+}
+
+var discoveryClasses = map[string]discoveryClass{
+	"temperature": {"temperature", "°C", "measurement"},
+	"humidity":    {"humidity", "%", "measurement"},
+	"vad":         {"voltage", "V", "measurement"},
+	"vdd":         {"voltage", "V", "measurement"},
+	"current":     {"current", "A", "measurement"},
+}
+
+// Metric types a sensor family is known to send, so mapped sensors can be
+// announced before they were seen
+var discoveryFamilyTypes = map[int][]string{
+	0x10: {"temperature"},
+	0x26: {"temperature", "current"},
+	0x28: {"temperature"},
+	0x29: {"pio0", "pio1", "pio2", "pio3", "pio4", "pio5", "pio6", "pio7"},
+	0x3a: {"pio0", "pio1"},
+}
+
+type discoveryAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type discoveryDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model,omitempty"`
+}
+
+// discoveryPayload is the configuration Home Assistant expects for an MQTT
+// sensor or binary sensor
+type discoveryPayload struct {
+	Name              string                  `json:"name"`
+	UniqueID          string                  `json:"unique_id"`
+	StateTopic        string                  `json:"state_topic"`
+	ValueTemplate     string                  `json:"value_template,omitempty"`
+	DeviceClass       string                  `json:"device_class,omitempty"`
+	UnitOfMeasurement string                  `json:"unit_of_measurement,omitempty"`
+	StateClass        string                  `json:"state_class,omitempty"`
+	PayloadOn         string                  `json:"payload_on,omitempty"`
+	PayloadOff        string                  `json:"payload_off,omitempty"`
+	Availability      []discoveryAvailability `json:"availability"`
+	AvailabilityMode  string                  `json:"availability_mode"`
+	Device            discoveryDevice         `json:"device"`
+}
+
+// discovery announces the sensors to Home Assistant, once for every sensor
+// and metric type, and again when its configuration changes
+type discovery struct {
+	Prefix    string
+	announced map[string]string
+	mapped    bool
+}
+
+func newDiscovery(c discoveryConfig) *discovery {
+	if !c.Enabled {
+		return nil
+	}
+
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = defaultDiscoveryPrefix
+	}
+
+	return &discovery{Prefix: prefix, announced: map[string]string{}}
+}
+
+// Announce publishes the configuration for the metrics that were not
+// announced yet, starting with the mapped sensors
+func (d *discovery) Announce(s *mqttSink, metrics []*Metric) {
+	if !d.mapped {
+		d.mapped = true
+		d.announce(s, mappedMetrics())
+	}
+
+	d.announce(s, metrics)
+}
+
+func (d *discovery) announce(s *mqttSink, metrics []*Metric) {
+	for _, m := range metrics {
+		// Skip statistics, heartbeats and payloads that could not be decoded
+		if m.ID == "" || m.IsRaw() || m.Type == "heartbeat" {
+			continue
+		}
+
+		topic := d.topic(m)
+
+		payload, err := json.Marshal(s.discoveryPayload(m))
+		if err != nil {
+			log.Errorf("Could not encode discovery for '%s': %s", m.ID, err)
+			continue
+		}
+
+		if d.announced[topic] == string(payload) {
+			continue
+		}
+
+		log.Printf("MQTT Sending to '%s': %s", topic, payload)
+
+		token := s.client.Publish(topic, 1, true, payload)
+		if !token.WaitTimeout(mqttTimeout) {
+			log.Errorf("Timeout publishing to '%s'", topic)
+			continue
+		} else if token.Error() != nil {
+			log.Errorf("Could not publish to '%s': %s", topic, token.Error())
+			continue
+		}
+
+		d.announced[topic] = string(payload)
+	}
+}
+
+// topic returns <prefix>/<component>/<object>/<type>/config, since one sensor
+// may send several metric types
+func (d *discovery) topic(m *Metric) string {
+	return path.Join(d.Prefix, discoveryComponent(m), discoveryObject(m), m.Type, "config")
+}
+
+// discoveryComponent returns binary_sensor for switch channels, which are
+// published as ON or OFF, and sensor for everything else
+func discoveryComponent(m *Metric) string {
+	if m.State != "" || strings.HasPrefix(m.Type, "pio") {
+		return "binary_sensor"
+	}
+
+	return "sensor"
+}
+
+// discoveryObject identifies the sensor to Home Assistant: its id, preceded
+// by the name prefix of the receiver when it has one, as every receiver then
+// publishes the sensor on its own topic
+func discoveryObject(m *Metric) string {
+	rc := receiverByName(m.Receiver)
+	if rc == nil || rc.NamePrefix == "" {
+		return m.ID
+	}
+
+	return discoveryInvalid.ReplaceAllString(rc.NamePrefix, "_") + "_" + m.ID
+}
+
+func (s *mqttSink) discoveryPayload(m *Metric) *discoveryPayload {
+	name := m.Name
+	if name == "" {
+		name = m.ID
+	}
+
+	c := &discoveryPayload{
+		Name:             name + " " + m.Type,
+		UniqueID:         "onewire_" + discoveryObject(m) + "_" + m.Type,
+		StateTopic:       s.topic(m),
+		Availability:     []discoveryAvailability{{Topic: mqttStatusTopic("")}},
+		AvailabilityMode: "all",
+	}
+
+	// Switch states are always published as is
+	if discoveryComponent(m) == "binary_sensor" {
+		c.PayloadOn, c.PayloadOff = "ON", "OFF"
+	} else {
+		class := discoveryClassFor(m.Type)
+
+		c.DeviceClass = class.DeviceClass
+		c.UnitOfMeasurement = class.Unit
+		c.StateClass = class.StateClass
+
+		if s.publishFor(c.StateTopic).Payload == mqttPayloadJSON {
+			c.ValueTemplate = "{{ value_json.value }}"
+		}
+	}
+
+	if m.Node != "" {
+		c.Availability = append(c.Availability, discoveryAvailability{Topic: mqttStatusTopic(m.Node)})
+		c.Device = discoveryDevice{Identifiers: []string{"onewire_" + m.Node}, Name: m.Node}
+
+		return c
+	}
+
+	c.Device = discoveryDevice{Identifiers: []string{"onewire_" + discoveryObject(m)}, Name: name}
+
+	if family, err := strconv.ParseInt(m.Family, 16, 0); err == nil && decoders[int(family)] != nil {
+		c.Device.Model = decoders[int(family)].Name
+	}
+
+	return c
+}
+
+func discoveryClassFor(metricType string) discoveryClass {
+	if class, ok := discoveryClasses[metricType]; ok {
+		return class
+	}
+
+	switch {
+	case strings.HasSuffix(metricType, "_delta"), strings.HasSuffix(metricType, "_rate"):
+		return discoveryClass{StateClass: "measurement"}
+	case strings.HasPrefix(metricType, "counter_"):
+		return discoveryClass{StateClass: "total_increasing"}
+	default:
+		return discoveryClass{}
+	}
+}
+
+// mappedMetrics returns placeholder metrics for the types the sensors in
+// the name mappings are known to send, for every receiver
+func mappedMetrics() []*Metric {
+	var metrics []*Metric
+
+	for i := range cfg.Receivers {
+		rc := &cfg.Receivers[i]
+
+		mapped := map[string]bool{}
+
+		for id := range cfg.NameMapping {
+			mapped[id] = true
+		}
+
+		for id := range rc.NameMapping {
+			mapped[id] = true
+		}
+
+		var ids []string
+
+		for id := range mapped {
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			metrics = append(metrics, mappedSensorMetrics(rc, id)...)
+		}
+	}
+
+	return metrics
+}
+
+func mappedSensorMetrics(rc *receiverConfig, id string) []*Metric {
+	if len(id) != frameIDSize*2 {
+		return nil
+	}
+
+	family, err := strconv.ParseInt(id[:2], 16, 0)
+	if err != nil {
+		return nil
+	}
+
+	types := discoveryFamilyTypes[int(family)]
+
+	if family == 0x26 && sensorConfigFor(id).Humidity != "" {
+		types = append(types[:len(types):len(types)], "humidity")
+	}
+
+	metrics := []*Metric{}
+
+	for _, t := range types {
+		metrics = append(metrics, &Metric{
+			Name:     idToName(rc, id),
+			ID:       id,
+			Type:     t,
+			Family:   id[:2],
+			Node:     nodeFor(rc, id),
+			Receiver: rc.Name,
+		})
+	}
+
+	return metrics
+}
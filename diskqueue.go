@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diskQueue is a FIFO of metrics in a file, one JSON document per line;
+// everything before the read offset has been consumed already. The offset
+// is kept in a separate file, so a next run continues where this one ended;
+// after a crash, metrics may be delivered twice but are not lost.
+// Optionally, the file is limited in size and metrics expire after a maximum
+// age.
+type diskQueue struct {
+	name    string
+	path    string
+	file    *os.File
+	offset  int64
+	size    int64
+	count   int
+	maxSize int64
+	maxAge  time.Duration
+
+	// Sync every push to disk before it is acknowledged
+	sync bool
+
+	// Position after the last Peek, until it is committed
+	peekOffset int64
+	peekCount  int
+}
+
+// Size of the consumed part from which the file is compacted
+const diskQueueCompactSize = 1 << 20
+
+var errDiskQueueFull = errors.New("disk queue is full")
+
+func openDiskQueue(name, path string, maxSize int64, maxAge time.Duration) (*diskQueue, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{name: name, path: path, file: f, maxSize: maxSize, maxAge: maxAge}
+
+	// Count what was left behind by a previous run, after the offset where
+	// it stopped reading
+	offset := q.readOffset()
+	valid := offset == 0
+	lines, consumed := 0, 0
+
+	reader := bufio.NewReader(f)
+
+	for {
+		data, err := reader.ReadBytes('\n')
+
+		if len(data) > 0 {
+			lines++
+
+			if q.size < offset {
+				consumed++
+			}
+		}
+
+		q.size += int64(len(data))
+		valid = valid || q.size == offset
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	// An offset that is not at the start of an entry can not be trusted
+	if !valid {
+		log.Errorf("Ignoring invalid offset %d for '%s'", offset, path)
+		offset, consumed = 0, 0
+	}
+
+	q.offset, q.count = offset, lines-consumed
+
+	return q, nil
+}
+
+func (q *diskQueue) offsetPath() string {
+	return q.path + ".offset"
+}
+
+// readOffset returns the offset that was saved by a previous run, or 0
+func (q *diskQueue) readOffset() int64 {
+	data, err := os.ReadFile(q.offsetPath())
+	if err != nil {
+		return 0
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+
+	return offset
+}
+
+// saveOffset stores the offset; the file is replaced, so it is never seen
+// half written
+func (q *diskQueue) saveOffset() error {
+	tmp := q.offsetPath() + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(f, "%d\n", q.offset); err != nil {
+		f.Close()
+		return err
+	}
+
+	if q.sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.offsetPath())
+}
+
+func (q *diskQueue) Len() int {
+	return q.count
+}
+
+// Push appends the metrics; when the file would grow beyond its maximum
+// size, none of them are added
+func (q *diskQueue) Push(metrics []*Metric) error {
+	var buffer bytes.Buffer
+
+	enc := json.NewEncoder(&buffer)
+
+	for _, m := range metrics {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	if q.maxSize > 0 && q.size+int64(buffer.Len()) > q.maxSize {
+		// Make room by dropping what was consumed already
+		if q.offset > 0 {
+			if err := q.compact(); err != nil {
+				return err
+			}
+		}
+
+		if q.size+int64(buffer.Len()) > q.maxSize {
+			return errDiskQueueFull
+		}
+	}
+
+	if _, err := q.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	n, err := q.file.Write(buffer.Bytes())
+	q.size += int64(n)
+
+	if err != nil {
+		return err
+	}
+
+	if q.sync {
+		if err := q.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	q.count += len(metrics)
+
+	return nil
+}
+
+// Peek reads up to n metrics from the front of the queue, skipping expired
+// ones, without consuming them; Commit consumes them
+func (q *diskQueue) Peek(n int) ([]*Metric, error) {
+	q.peekOffset, q.peekCount = q.offset, q.count
+
+	if q.count == 0 || n <= 0 {
+		return nil, nil
+	}
+
+	if _, err := q.file.Seek(q.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(q.file)
+	metrics := []*Metric{}
+
+	for len(metrics) < n {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		}
+
+		if err != nil && err != io.EOF {
+			return metrics, err
+		}
+
+		q.peekOffset += int64(len(data))
+		q.peekCount--
+
+		m := &Metric{}
+		if err := json.Unmarshal(data, m); err != nil {
+			log.Errorf("Skipping corrupt entry in '%s': %s", q.path, err)
+			continue
+		}
+
+		if q.maxAge > 0 && time.Since(m.Timestamp) > q.maxAge {
+			stats.Inc("sink." + q.name + ".expired")
+			continue
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	return metrics, nil
+}
+
+// Commit consumes what was returned by the last Peek, and saves the new
+// offset; once the queue is empty, the file is truncated
+func (q *diskQueue) Commit() error {
+	q.offset, q.count = q.peekOffset, q.peekCount
+
+	// Reclaim the consumed part once it makes up most of a large file, as a
+	// queue that is never empty would otherwise grow forever
+	if q.count > 0 && q.offset >= diskQueueCompactSize && q.offset >= q.size/2 {
+		return q.compact()
+	}
+
+	if q.count > 0 {
+		return q.saveOffset()
+	}
+
+	q.count, q.offset, q.size = 0, 0, 0
+	q.peekOffset, q.peekCount = 0, 0
+
+	// The offset goes first: should the truncate not happen, the consumed
+	// metrics are sent again rather than new ones skipped
+	if err := q.saveOffset(); err != nil {
+		return err
+	}
+
+	return q.file.Truncate(0)
+}
+
+// Pop takes up to n metrics from the front of the queue
+func (q *diskQueue) Pop(n int) ([]*Metric, error) {
+	metrics, err := q.Peek(n)
+	if err != nil {
+		return metrics, err
+	}
+
+	return metrics, q.Commit()
+}
+
+// Close compacts the file to what was not consumed yet, so a next run does
+// not replay it again
+func (q *diskQueue) Close() error {
+	if q.offset > 0 {
+		if err := q.compact(); err != nil {
+			q.file.Close()
+			return err
+		}
+	}
+
+	return q.file.Close()
+}
+
+// compact rewrites the file without the consumed metrics, and continues with
+// the new file
+func (q *diskQueue) compact() error {
+	if _, err := q.file.Seek(q.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(q.path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, q.file); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	size, offset := q.size-q.offset, q.offset
+
+	// As with truncating, a crash in between sends metrics twice at worst
+	q.offset = 0
+	if err := q.saveOffset(); err != nil {
+		q.offset = offset
+		tmp.Close()
+
+		return err
+	}
+
+	if err := os.Rename(q.path+".tmp", q.path); err != nil {
+		tmp.Close()
+
+		q.offset = offset
+		if err := q.saveOffset(); err != nil {
+			log.Errorf("Could not restore the offset for '%s': %s", q.path, err)
+		}
+
+		return err
+	}
+
+	q.file.Close()
+	q.file, q.size = tmp, size
+	q.peekOffset, q.peekCount = 0, q.count
+
+	return nil
+}
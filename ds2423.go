@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ds2423CounterSize = 4
+
+	// A counter dropping from above ds2423WrapHigh to below ds2423WrapLow is
+	// considered a wrap-around, any other drop a reset of the counter
+	ds2423WrapHigh = 0xF0000000
+	ds2423WrapLow  = 0x10000000
+)
+
+type counterReading struct {
+	Value uint32
+	At    time.Time
+}
+
+var counterReadings = map[string]counterReading{}
+
+// payloadDS2423 decodes a list of 32 bit little endian counters, and derives
+// a delta and a per second rate from the previous reading of each counter
+func payloadDS2423(f *frame) ([]*Metric, error) {
+	payload := f.Payload
+
+	if len(payload) < ds2423CounterSize || len(payload)%ds2423CounterSize != 0 {
+		return nil, fmt.Errorf("DS2423 payload has invalid length: %d bytes", len(payload))
+	}
+
+	metrics := []*Metric{}
+
+	for i := 0; i < len(payload)/ds2423CounterSize; i++ {
+		c := payload[i*ds2423CounterSize : (i+1)*ds2423CounterSize]
+		value := uint32(c[3])<<24 | uint32(c[2])<<16 | uint32(c[1])<<8 | uint32(c[0])
+		name := fmt.Sprintf("counter_%c", 'a'+i)
+
+		metrics = append(metrics, &Metric{Type: name, Value: float64(value)})
+
+		// Every receiver hears its own series of readings
+		key := f.Receiver + "/" + f.ID + "/" + name
+		prev, ok := counterReadings[key]
+		counterReadings[key] = counterReading{Value: value, At: f.Timestamp}
+
+		if !ok {
+			continue
+		}
+
+		delta := counterDelta(prev.Value, value)
+		if value < prev.Value && delta == value {
+			log.Infof("Counter '%s' was reset (%d -> %d)", key, prev.Value, value)
+		}
+
+		metrics = append(metrics, &Metric{Type: name + "_delta", Value: float64(delta)})
+
+		if seconds := f.Timestamp.Sub(prev.At).Seconds(); seconds > 0 {
+			metrics = append(metrics, &Metric{Type: name + "_rate", Value: float64(delta) / seconds})
+		}
+	}
+
+	return metrics, nil
+}
+
+func counterDelta(prev, value uint32) uint32 {
+	if value >= prev {
+		return value - prev
+	}
+
+	if prev >= ds2423WrapHigh && value < ds2423WrapLow {
+		// uint32 arithmetic takes care of the wrap-around
+		return value - prev
+	}
+
+	// The counter was reset, count from 0
+	return value
+}
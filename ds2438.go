@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	ds2438ScratchpadSize = 9
+	ds2438ConfigAD       = 0x08
+
+	// Sense resistor in ohm when none is configured for the sensor
+	ds2438DefaultSenseResistor = 0.05
+)
+
+// payloadDS2438 decodes one or more page 0 scratchpads of a DS2438; the AD
+// bit in the configuration register tells whether the voltage is VDD or VAD
+func payloadDS2438(f *frame) ([]*Metric, error) {
+	payload := f.Payload
+
+	sc := sensorConfigFor(f.ID)
+
+	senseResistor := sc.SenseResistor
+	if senseResistor <= 0 {
+		senseResistor = ds2438DefaultSenseResistor
+	}
+
+	var (
+		temp     float64
+		vad, vdd float64
+		hasVAD   bool
+		hasVDD   bool
+	)
+
+	for i := 0; i+ds2438ScratchpadSize <= len(payload); i += ds2438ScratchpadSize {
+		page := payload[i : i+ds2438ScratchpadSize]
+
+		temp = float64(int16(page[2]<<8|page[1])>>3) * 0.03125
+		voltage := float64((page[4]&0x03)<<8|page[3]) * 0.01
+
+		if page[0]&ds2438ConfigAD != 0 {
+			vdd, hasVDD = voltage, true
+		} else {
+			vad, hasVAD = voltage, true
+		}
+	}
+
+	current := float64(int16(payload[6]<<8|payload[5])) / (4096 * senseResistor)
+
+	metrics := []*Metric{
+		{Type: "temperature", Value: temp},
+		{Type: "current", Value: current},
+	}
+
+	if hasVAD {
+		metrics = append(metrics, &Metric{Type: "vad", Value: vad})
+	}
+
+	if hasVDD {
+		metrics = append(metrics, &Metric{Type: "vdd", Value: vdd})
+	}
+
+	if sc.Humidity == "" {
+		return metrics, nil
+	}
+
+	// The frame itself is fine, so only the humidity is left out
+	if !hasVAD || !hasVDD {
+		stats.Inc("frames.humidity_errors")
+		log.Errorf("Humidity conversion for '%s' needs both VAD and VDD", f.ID)
+
+		return metrics, nil
+	}
+
+	rh, err := humidity(sc.Humidity, vad, vdd, temp)
+	if err != nil {
+		stats.Inc("frames.humidity_errors")
+		log.Errorf("Could not convert humidity for '%s': %s", f.ID, err)
+
+		return metrics, nil
+	}
+
+	return append(metrics, &Metric{Type: "humidity", Value: rh}), nil
+}
+
+func humidity(sensor string, vad, vdd, temp float64) (float64, error) {
+	if vdd == 0 {
+		return 0, fmt.Errorf("VDD is 0")
+	}
+
+	switch sensor {
+	case "hih4000":
+		rh := (vad/vdd - 0.16) / 0.0062
+		rh = rh / (1.0546 - 0.00216*temp)
+
+		return math.Max(0, math.Min(100, rh)), nil
+	default:
+		return 0, fmt.Errorf("unknown humidity sensor '%s'", sensor)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Receivers send timestamps relative to their own uptime when they have no
+	// clock; anything before this is not considered a wall clock timestamp
+	minFrameTimestamp = 1000000000
+
+	frameIDSize     = 8
+	frameHeaderSize = 2 + frameIDSize
+
+	familyNode = 0x00
+)
+
+type frame struct {
+	Status    int
+	Timestamp time.Time
+	ID        string
+	Family    int
+	Payload   []int
+
+	// Receiver is the name of the receiver the frame came from
+	Receiver string
+}
+
+func (f *frame) OK() bool {
+	return f.Status == 0
+}
+
+// frameError is returned for frames that are rejected; Reason is used as
+// the name of the counter
+type frameError struct {
+	Reason string
+	Err    error
+}
+
+func (e *frameError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func rejectFrame(reason string, format string, args ...interface{}) *frameError {
+	return &frameError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+func rejectReason(err error, fallback string) string {
+	var fe *frameError
+	if errors.As(err, &fe) {
+		return fe.Reason
+	}
+
+	return fallback
+}
+
+func parseFrame(message string, received time.Time) (*frame, error) {
+	data := strings.Fields(message)
+	if len(data) < frameHeaderSize {
+		return nil, rejectFrame("fields", "expected at least %d fields, got %d", frameHeaderSize, len(data))
+	}
+
+	status, err := strconv.Atoi(data[0])
+	if err != nil {
+		return nil, rejectFrame("status", "invalid status '%s'", data[0])
+	}
+
+	ts, err := strconv.ParseInt(data[1], 10, 64)
+	if err != nil {
+		return nil, rejectFrame("timestamp", "invalid timestamp '%s'", data[1])
+	}
+
+	bytes, err := stringsToIntegers(data[2:])
+	if err != nil {
+		return nil, rejectFrame("byte", "%s", err)
+	}
+
+	for i, b := range bytes {
+		if b < 0 || b > 255 {
+			return nil, rejectFrame("byte", "byte %d out of range: %d", i, b)
+		}
+	}
+
+	rom := bytes[:frameIDSize]
+
+	f := &frame{
+		Status:    status,
+		Timestamp: received,
+		ID:        hexString(rom),
+		Family:    rom[0],
+		Payload:   bytes[frameIDSize:],
+	}
+
+	if ts >= minFrameTimestamp {
+		f.Timestamp = time.Unix(ts, 0)
+	}
+
+	// Node ids are assigned by the firmware and carry no CRC
+	if f.Family != familyNode && crc8(rom[:frameIDSize-1]) != rom[frameIDSize-1] {
+		return nil, rejectFrame("crc", "ROM CRC mismatch for '%s'", f.ID)
+	}
+
+	if d, ok := decoders[f.Family]; ok && len(f.Payload) < d.MinPayload {
+		return nil, rejectFrame("length", "%s payload for '%s' needs at least %d bytes, got %d",
+			d.Name, f.ID, d.MinPayload, len(f.Payload))
+	}
+
+	return f, nil
+}
+
+// crc8 calculates the Dallas/Maxim 1-Wire CRC8 (polynomial x^8 + x^5 + x^4 + 1)
+func crc8(data []int) int {
+	crc := 0
+
+	for _, b := range data {
+		for i := 0; i < 8; i++ {
+			mix := (crc ^ b) & 0x01
+			crc >>= 1
+
+			if mix != 0 {
+				crc ^= 0x8c
+			}
+
+			b >>= 1
+		}
+	}
+
+	return crc
+}
+
+func hexString(data []int) string {
+	var buffer strings.Builder
+
+	for _, b := range data {
+		buffer.WriteString(fmt.Sprintf("%02x", b))
+	}
+
+	return buffer.String()
+}
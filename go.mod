@@ -4,7 +4,6 @@ go 1.19
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.1
-	github.com/marpaia/graphite-golang v0.0.0-20190519024811-caf161d2c2b1
 	github.com/sirupsen/logrus v1.9.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	gopkg.in/yaml.v2 v2.4.0
@@ -1,51 +1,345 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"math"
+	"net"
 	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	graphitePlaintext = "plaintext"
+	graphiteUDP       = "udp"
+	graphitePickle    = "pickle"
 
-	"github.com/marpaia/graphite-golang"
+	defaultGraphiteTimeout  = 5 * time.Second
+	graphiteProbeTimeout    = time.Millisecond
+	defaultGraphiteTemplate = "{{.Name}}.{{.Type}}.value"
 )
 
-func newGraphiteClient() *graphite.Graphite {
-	// try to connect a graphiteClient server
-	graphiteClient, err := graphite.NewGraphite(cfg.Graphite.Configuration.Host, cfg.Graphite.Configuration.Port)
+var defaultGraphitePorts = map[string]int{
+	graphitePlaintext: 2003,
+	graphiteUDP:       2003,
+	graphitePickle:    2004,
+}
+
+// graphiteSink keeps a connection to carbon open, and reconnects with an
+// increasing delay after it failed
+type graphiteSink struct {
+	Address  string
+	Protocol string
+	Prefix   string
+	Timeout  time.Duration
+	Template *template.Template
+	Tags     bool
+
+	conn    net.Conn
+	delay   time.Duration
+	retryAt time.Time
+	lastErr error
+}
+
+func newGraphiteSink() (Sink, error) {
+	c := cfg.Graphite.Configuration
+
+	if c.Host == "" {
+		return nil, fmt.Errorf("no graphite host configured")
+	}
+
+	s := &graphiteSink{
+		Protocol: c.Protocol,
+		Prefix:   c.Prefix,
+		Timeout:  c.Timeout,
+		Tags:     c.Tags,
+	}
+
+	text := c.Template
+	if text == "" {
+		text = defaultGraphiteTemplate
+	}
+
+	t, err := parseMetricTemplate("graphite", text)
 	if err != nil {
-		log.Fatal("An error has occurred while trying to create a Graphite connector:", err)
-		os.Exit(1)
+		return nil, err
+	}
+
+	s.Template = t
+
+	if s.Protocol == "" {
+		s.Protocol = graphitePlaintext
+	}
+
+	port, ok := defaultGraphitePorts[s.Protocol]
+	if !ok {
+		return nil, fmt.Errorf("unknown graphite protocol '%s'", c.Protocol)
+	}
+
+	if c.Port != 0 {
+		port = c.Port
 	}
 
-	graphiteClient.Prefix = cfg.Graphite.Configuration.Prefix
+	if s.Timeout <= 0 {
+		s.Timeout = defaultGraphiteTimeout
+	}
 
-	log.Printf("Loaded Graphite connection: %s:%d", cfg.Graphite.Configuration.Host, cfg.Graphite.Configuration.Port)
+	s.Address = net.JoinHostPort(c.Host, fmt.Sprintf("%d", port))
 
-	return graphiteClient
+	return s, nil
 }
 
-func sendGraphite(graphite *graphite.Graphite, input chan *Metric) {
-	for {
-		message := <-input
+func (s *graphiteSink) Start() error {
+	log.Printf("Loaded Graphite connection: %s://%s", s.Protocol, s.Address)
+
+	return nil
+}
 
-		log.Printf("Graphite Sending to '%s': %#v", message.GraphiteName(), message)
+func (s *graphiteSink) Write(metrics []*Metric) error {
+	batch := []*Metric{}
 
-		if err := graphite.Connect(); err != nil {
-			log.Println(err)
+	for _, m := range metrics {
+		if m.IsRaw() {
 			continue
 		}
 
-		graphite.SimpleSend(message.GraphiteName(), message.GraphiteValue())
+		log.Printf("Graphite Sending to '%s': %#v", s.path(m), m)
 
-		if err := graphite.Disconnect(); err != nil {
-			log.Println(err)
+		batch = append(batch, m)
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	s.lastErr = s.send(batch)
+
+	return s.lastErr
+}
+
+func (s *graphiteSink) send(batch []*Metric) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	if s.Protocol == graphiteUDP {
+		// Every datagram has to fit in a single packet, so send them one by one
+		for _, m := range batch {
+			if err := s.write([]byte(s.line(m))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var payload []byte
+
+	if s.Protocol == graphitePickle {
+		payload = s.pickle(batch)
+	} else {
+		var buffer bytes.Buffer
+
+		for _, m := range batch {
+			buffer.WriteString(s.line(m))
 		}
+
+		payload = buffer.Bytes()
 	}
+
+	return s.write(payload)
 }
 
-func (m *Metric) GraphiteValue() string {
-	return fmt.Sprintf("%f", m.Value)
+func (s *graphiteSink) connect() error {
+	if s.conn != nil && !s.closedByPeer() {
+		return nil
+	}
+
+	s.disconnect()
+
+	if time.Now().Before(s.retryAt) {
+		return fmt.Errorf("not connected to %s, retrying in %s", s.Address, time.Until(s.retryAt).Round(time.Second))
+	}
+
+	network := "tcp"
+	if s.Protocol == graphiteUDP {
+		network = "udp"
+	}
+
+	conn, err := net.DialTimeout(network, s.Address, s.Timeout)
+	if err != nil {
+		s.backoff()
+		return err
+	}
+
+	log.Printf("Connected to Graphite: %s://%s", s.Protocol, s.Address)
+
+	s.conn = conn
+	s.delay = 0
+
+	return nil
 }
 
-func (m *Metric) GraphiteName() string {
-	return strings.Join([]string{m.Name, m.Type, "value"}, ".")
+// closedByPeer tells whether carbon closed or reset the connection since the
+// last write; a write on such a connection still succeeds locally, and the
+// batch would be lost. Carbon never sends anything, so a read that does not
+// time out means the connection is gone.
+func (s *graphiteSink) closedByPeer() bool {
+	if s.Protocol == graphiteUDP {
+		return false
+	}
+
+	if err := s.conn.SetReadDeadline(time.Now().Add(graphiteProbeTimeout)); err != nil {
+		return true
+	}
+
+	var b [1]byte
+
+	_, err := s.conn.Read(b[:])
+
+	if err := s.conn.SetReadDeadline(time.Time{}); err != nil {
+		return true
+	}
+
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return false
+	}
+
+	log.Warnf("Connection to Graphite %s was closed: %v", s.Address, err)
+
+	return true
+}
+
+func (s *graphiteSink) backoff() {
+	if s.delay == 0 {
+		s.delay = minReconnectDelay
+	} else if s.delay *= 2; s.delay > maxReconnectDelay {
+		s.delay = maxReconnectDelay
+	}
+
+	s.retryAt = time.Now().Add(s.delay)
+}
+
+// write sends data over the connection; on any failure the connection is
+// dropped, so the next write reconnects
+func (s *graphiteSink) write(data []byte) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.Timeout)); err != nil {
+		s.disconnect()
+		return err
+	}
+
+	n, err := s.conn.Write(data)
+	if err == nil && n != len(data) {
+		err = fmt.Errorf("short write to %s: %d of %d bytes", s.Address, n, len(data))
+	}
+
+	if err != nil {
+		s.disconnect()
+		s.backoff()
+	}
+
+	return err
+}
+
+func (s *graphiteSink) disconnect() {
+	if s.conn == nil {
+		return
+	}
+
+	s.conn.Close()
+	s.conn = nil
+}
+
+// path renders the metric path from the template, followed by the tags
+// when enabled (graphite 1.1 syntax: path;tag=value;...)
+func (s *graphiteSink) path(m *Metric) string {
+	var buffer strings.Builder
+
+	if s.Prefix != "" {
+		buffer.WriteString(s.Prefix + ".")
+	}
+
+	if err := s.Template.Execute(&buffer, m); err != nil {
+		log.Errorf("Could not render graphite path for '%s': %s", m.ID, err)
+	}
+
+	if !s.Tags {
+		return buffer.String()
+	}
+
+	tags := [][2]string{
+		{"sensor", m.ID},
+		{"family", m.Family},
+		{"type", m.Type},
+		{"node", m.Node},
+		{"receiver", m.Receiver},
+	}
+
+	for _, t := range tags {
+		// Empty values are not allowed, and ; and ~ have a special meaning
+		if t[1] == "" || strings.ContainsAny(t[1], ";~") {
+			continue
+		}
+
+		buffer.WriteString(";" + t[0] + "=" + t[1])
+	}
+
+	return buffer.String()
+}
+
+func (s *graphiteSink) line(m *Metric) string {
+	return fmt.Sprintf("%s %s %d\n", s.path(m), m.GraphiteValue(), m.Timestamp.Unix())
+}
+
+// pickle encodes the batch as a list of (path, (timestamp, value)) tuples
+// with pickle protocol 2, prefixed by its length as carbon expects
+func (s *graphiteSink) pickle(batch []*Metric) []byte {
+	var buffer bytes.Buffer
+
+	buffer.Write([]byte{0x80, 0x02, ']', '('})
+
+	for _, m := range batch {
+		path := s.path(m)
+
+		buffer.WriteByte('X')
+		binary.Write(&buffer, binary.LittleEndian, uint32(len(path)))
+		buffer.WriteString(path)
+
+		pickleFloat(&buffer, float64(m.Timestamp.Unix()))
+		pickleFloat(&buffer, m.Value)
+
+		buffer.Write([]byte{0x86, 0x86})
+	}
+
+	buffer.Write([]byte{'e', '.'})
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(buffer.Len()))
+
+	return append(header, buffer.Bytes()...)
+}
+
+func pickleFloat(buffer *bytes.Buffer, f float64) {
+	buffer.WriteByte('G')
+	binary.Write(buffer, binary.BigEndian, math.Float64bits(f))
+}
+
+func (s *graphiteSink) Flush() error {
+	return nil
+}
+
+func (s *graphiteSink) Close() error {
+	s.disconnect()
+
+	return nil
+}
+
+func (s *graphiteSink) Health() error {
+	return s.lastErr
+}
+
+func (m *Metric) GraphiteValue() string {
+	return fmt.Sprintf("%f", m.Value)
 }
@@ -0,0 +1,33 @@
+package main
+
+// logSink only logs the metrics, which is useful while developing or
+// replaying without any backend
+type logSink struct{}
+
+func newLogSink() (Sink, error) {
+	return &logSink{}, nil
+}
+
+func (s *logSink) Start() error {
+	return nil
+}
+
+func (s *logSink) Write(metrics []*Metric) error {
+	for _, m := range metrics {
+		log.Printf("Metric: %#v", m)
+	}
+
+	return nil
+}
+
+func (s *logSink) Flush() error {
+	return nil
+}
+
+func (s *logSink) Close() error {
+	return nil
+}
+
+func (s *logSink) Health() error {
+	return nil
+}
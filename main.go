@@ -2,6 +2,9 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 )
@@ -17,17 +20,77 @@ func main() {
 		os.Exit(1)
 	}
 
-	sif := newTTYReceiver()
-	mqttClient := newMQTTClient()
-	graphiteClient := newGraphiteClient()
+	receivers := make([]receiver, len(cfg.Receivers))
 
-	ttyInput := make(chan string, 10)
-	graphiteOutput := make(chan *Metric, 10)
-	mqttOutput := make(chan *Metric, 10)
+	for i := range cfg.Receivers {
+		r, err := newReceiver(cfg.Receivers[i])
+		if err != nil {
+			log.Fatal("An error has occurred while setting up the receiver:", err)
+			os.Exit(1)
+		}
 
-	go readFromTTY(sif, ttyInput)
-	go sendGraphite(graphiteClient, graphiteOutput)
-	go sendMQTT(mqttClient, mqttOutput)
+		receivers[i] = r
+	}
+
+	if cfg.Capture.Path != "" {
+		c, err := newCaptureWriter(cfg.Capture)
+		if err != nil {
+			log.Fatal("An error has occurred while opening the capture file:", err)
+			os.Exit(1)
+		}
+
+		capture = c
+	}
+
+	sinks := []*sinkRunner{}
+
+	for _, name := range enabledSinks() {
+		r, err := startSink(name)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		sinks = append(sinks, r)
+	}
+
+	if len(sinks) == 0 {
+		log.Fatal("No sinks could be started")
+		os.Exit(1)
+	}
+
+	ttyInput := make(chan *line, 10)
+
+	var receiving sync.WaitGroup
+
+	for i, r := range receivers {
+		receiving.Add(1)
+
+		go func(rc *receiverConfig, r receiver) {
+			defer receiving.Done()
+			readFromReceiver(rc, r, ttyInput)
+		}(&cfg.Receivers[i], r)
+	}
+
+	// Only finite receivers (eg. a replay) ever end; once all of them did,
+	// the remaining metrics are sent before exiting
+	go func() {
+		receiving.Wait()
+		close(ttyInput)
+	}()
+
+	// Stop cleanly on a signal, so the sinks can send or store what is still
+	// queued; a second signal kills the daemon right away
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	parseInput(ttyInput, quit, sinks)
+
+	signal.Stop(quit)
+
+	for _, s := range sinks {
+		s.Stop()
+	}
 
-	parseInput(ttyInput, graphiteOutput, mqttOutput)
+	capture.Close()
 }
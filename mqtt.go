@@ -1,59 +1,352 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"strings"
+	"text/template"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-func newMQTTClient() mqtt.Client {
+const (
+	// How long to wait for the broker to acknowledge a connect or publish
+	mqttTimeout = 10 * time.Second
+
+	defaultMQTTClientID    = "onewire_logger"
+	defaultMQTTKeepAlive   = 300 * time.Second
+	defaultMQTTPingTimeout = 1 * time.Second
+	defaultMQTTTopic       = "{{if .Name}}{{.Name}}{{else}}{{.ID}}{{end}}/{{.Type}}"
+)
+
+// mqttSink publishes to the broker; the first connection is retried in the
+// background with an increasing delay, after which the client reconnects by
+// itself. While there is no connection, writes fail so the metrics stay in
+// the write-ahead queue (when the sink is persistent)
+type mqttSink struct {
+	client  mqtt.Client
+	lastErr error
+	done    chan struct{}
+
+	Topic   *template.Template
+	Publish mqttPublish
+	Rules   []mqttRule
+
+	nodes     *nodeAvailability
+	discovery *discovery
+}
+
+func newMQTTSink() (Sink, error) {
+	if cfg.MQTT.Host == "" {
+		return nil, fmt.Errorf("no MQTT host configured")
+	}
+
+	c := cfg.MQTT
+
+	s := &mqttSink{
+		done:      make(chan struct{}),
+		nodes:     newNodeAvailability(c.Availability),
+		discovery: newDiscovery(c.Discovery),
+	}
+
+	topic := c.TopicTemplate
+	if topic == "" {
+		topic = defaultMQTTTopic
+	}
+
+	var err error
+
+	if s.Topic, err = parseMetricTemplate("topic", topic); err != nil {
+		return nil, err
+	}
+
+	defaults := mqttPublish{Retain: true, Payload: mqttPayloadJSON}
+
+	if s.Publish, err = newMQTTPublish(defaults, &c.QoS, c.Retain, c.Payload, c.PayloadTemplate); err != nil {
+		return nil, err
+	}
+
+	if s.Rules, err = newMQTTRules(s.Publish); err != nil {
+		return nil, err
+	}
+
+	if s.client, err = newMQTTClient(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func newMQTTClient() (mqtt.Client, error) {
 	mqtt.ERROR = log
 
-	opts := mqtt.NewClientOptions().AddBroker(cfg.MQTT.Host).SetClientID("onewire_logger")
+	c := cfg.MQTT
+
+	clientID, err := mqttClientID()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(c.Host).SetClientID(clientID)
+
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = defaultMQTTKeepAlive
+	}
+
+	if c.PingTimeout <= 0 {
+		c.PingTimeout = defaultMQTTPingTimeout
+	}
 
-	opts.SetKeepAlive(300 * time.Second)
+	opts.SetKeepAlive(c.KeepAlive)
 
-	opts.SetPingTimeout(1 * time.Second)
-	opts.Username = cfg.MQTT.Username
-	opts.Password = cfg.MQTT.Password
+	opts.SetPingTimeout(c.PingTimeout)
+	opts.Username = c.Username
+	opts.Password = c.Password
+
+	if c.CleanSession != nil {
+		opts.SetCleanSession(*c.CleanSession)
+	}
+
+	if t, err := mqttTLSConfig(c.TLS); err != nil {
+		return nil, err
+	} else if t != nil {
+		opts.SetTLSConfig(t)
+	}
+
+	opts.SetConnectTimeout(mqttTimeout)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxReconnectDelay)
+	// The broker marks the daemon offline when the connection is lost
+	opts.SetWill(mqttStatusTopic(""), availabilityOffline, 1, true)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		stats.Set("sink.mqtt.connected", 1)
+		log.Printf("Connected to MQTT broker %s", cfg.MQTT.Host)
+
+		client.Publish(mqttStatusTopic(""), 1, true, availabilityOnline)
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		stats.Set("sink.mqtt.connected", 0)
+		stats.Inc("sink.mqtt.disconnects")
+		log.Errorf("Lost connection to MQTT broker %s: %s", cfg.MQTT.Host, err)
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		log.Printf("Reconnecting to MQTT broker %s", cfg.MQTT.Host)
+	})
 
 	client := mqtt.NewClient(opts)
 
-	log.Printf("Loaded MQTT connection: %s@%s", cfg.MQTT.Username, cfg.MQTT.Host)
+	log.Printf("Loaded MQTT connection: %s@%s as '%s'", c.Username, c.Host, clientID)
 
-	return client
+	return client, nil
 }
 
-func sendMQTT(client mqtt.Client, input chan *Metric) {
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+// mqttClientID returns the configured client id, with the hostname or a
+// random suffix so several daemons can share a broker
+func mqttClientID() (string, error) {
+	id := cfg.MQTT.ClientID
+	if id == "" {
+		id = defaultMQTTClientID
+	}
+
+	switch cfg.MQTT.ClientIDSuffix {
+	case "":
+		return id, nil
+	case "hostname":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("could not determine the hostname for the MQTT client id: %w", err)
+		}
+
+		return id + "_" + hostname, nil
+	case "random":
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+
+		return id + "_" + hex.EncodeToString(suffix), nil
+	default:
+		return "", fmt.Errorf("unknown MQTT client_id_suffix '%s'", cfg.MQTT.ClientIDSuffix)
+	}
+}
+
+// mqttTLSConfig builds the TLS configuration, or returns nil when TLS is not
+// configured
+func mqttTLSConfig(c tlsConfig) (*tls.Config, error) {
+	if c == (tlsConfig{}) {
+		return nil, nil
+	}
+
+	t := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read MQTT CA file: %w", err)
+		}
+
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in MQTT CA file '%s'", c.CAFile)
+		}
 	}
 
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load MQTT client certificate: %w", err)
+		}
+
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return t, nil
+}
+
+// Start does not wait for the broker, so the daemon also starts while it is
+// down
+func (s *mqttSink) Start() error {
+	stats.Set("sink.mqtt.connected", 0)
+
+	go s.connect()
+
+	return nil
+}
+
+// connect keeps trying to connect until it succeeds or the sink is closed
+func (s *mqttSink) connect() {
+	delay := minReconnectDelay
+
 	for {
-		message := <-input
+		var err error
+
+		token := s.client.Connect()
+		if !token.WaitTimeout(mqttTimeout) {
+			err = fmt.Errorf("timeout")
+		} else if err = token.Error(); err == nil {
+			return
+		}
+
+		log.Errorf("Could not connect to MQTT broker %s, retrying in %s: %s", cfg.MQTT.Host, delay, err)
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (s *mqttSink) Write(metrics []*Metric) error {
+	if !s.client.IsConnectionOpen() {
+		s.lastErr = fmt.Errorf("not connected to %s", cfg.MQTT.Host)
+		return s.lastErr
+	}
+
+	if s.discovery != nil {
+		s.discovery.Announce(s, metrics)
+	}
+
+	var err error
+
+	for _, m := range metrics {
+		if node := heartbeatNode(m); node != "" && s.nodes.Heartbeat(node, m.Timestamp) {
+			s.publishStatus(node, availabilityOnline)
+		}
+
+		topic := s.topic(m)
 
-		log.Printf("MQTT Sending to '%s': %#v", message.MQTTTopic(), message)
+		log.Printf("MQTT Sending to '%s': %#v", topic, m)
 
-		token := client.Publish(message.MQTTTopic(), 0, true, message.MQTTValue())
-		token.Wait()
+		p := s.publishFor(topic)
 
-		if token.Error() != nil {
-			log.Println(token.Error())
+		token := s.client.Publish(topic, p.QoS, p.Retain, p.payload(m))
+		if !token.WaitTimeout(mqttTimeout) {
+			err = fmt.Errorf("timeout publishing to '%s'", topic)
+		} else if token.Error() != nil {
+			err = token.Error()
 		}
 	}
+
+	s.lastErr = err
+
+	return err
 }
 
-func (m *Metric) MQTTTopic() string {
-	return path.Join(cfg.MQTT.TopicPrefix, m.Name, m.Type)
+// Flush marks the nodes that missed their heartbeats offline
+func (s *mqttSink) Flush() error {
+	if !s.client.IsConnectionOpen() {
+		return nil
+	}
+
+	for _, node := range s.nodes.Expire(time.Now()) {
+		s.publishStatus(node, availabilityOffline)
+	}
+
+	return nil
 }
 
-func (m *Metric) MQTTValue() string {
-	u, err := json.Marshal(m)
-	if err != nil {
-		return ""
+// Close marks the daemon offline itself, since the broker only sends the
+// will when the connection is lost
+func (s *mqttSink) Close() error {
+	close(s.done)
+
+	if s.client.IsConnectionOpen() {
+		s.publishStatus("", availabilityOffline)
+	}
+
+	s.client.Disconnect(250)
+
+	return nil
+}
+
+// publishStatus publishes the availability of a node, or of the daemon
+// itself for node ""
+func (s *mqttSink) publishStatus(node, status string) {
+	topic := mqttStatusTopic(node)
+
+	log.Printf("MQTT Sending to '%s': %s", topic, status)
+
+	token := s.client.Publish(topic, 1, true, status)
+	if !token.WaitTimeout(mqttTimeout) {
+		log.Errorf("Timeout publishing to '%s'", topic)
+	} else if token.Error() != nil {
+		log.Errorf("Could not publish to '%s': %s", topic, token.Error())
+	}
+}
+
+// mqttStatusTopic returns the availability topic of a node, or of the
+// daemon itself for node ""
+func mqttStatusTopic(node string) string {
+	return path.Join(cfg.MQTT.TopicPrefix, node, "status")
+}
+
+func (s *mqttSink) Health() error {
+	if !s.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected")
+	}
+
+	return s.lastErr
+}
+
+// topic renders the topic template below the topic prefix
+func (s *mqttSink) topic(m *Metric) string {
+	var buffer strings.Builder
+
+	if err := s.Topic.Execute(&buffer, m); err != nil {
+		log.Errorf("Could not render MQTT topic for '%s': %s", m.ID, err)
 	}
 
-	return string(u)
+	return path.Join(cfg.MQTT.TopicPrefix, buffer.String())
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Payload formats
+const (
+	mqttPayloadJSON     = "json"
+	mqttPayloadValue    = "value"
+	mqttPayloadTemplate = "template"
+)
+
+// mqttPublish is how metrics are published to a topic
+type mqttPublish struct {
+	QoS             byte
+	Retain          bool
+	Payload         string
+	PayloadTemplate *template.Template
+}
+
+// mqttRule overrides how metrics are published, for the topics that match
+// its filter
+type mqttRule struct {
+	Match string
+	mqttPublish
+}
+
+// newMQTTPublish applies the settings to the defaults; a rule only changes
+// what it sets
+func newMQTTPublish(defaults mqttPublish, qos *int, retain *bool, payload, payloadTemplate string) (mqttPublish, error) {
+	p := defaults
+
+	if qos != nil {
+		if *qos < 0 || *qos > 2 {
+			return p, fmt.Errorf("MQTT qos must be 0, 1 or 2, got %d", *qos)
+		}
+
+		p.QoS = byte(*qos)
+	}
+
+	if retain != nil {
+		p.Retain = *retain
+	}
+
+	if payload == "" {
+		return p, nil
+	}
+
+	p.Payload, p.PayloadTemplate = payload, nil
+
+	switch payload {
+	case mqttPayloadJSON, mqttPayloadValue:
+	case mqttPayloadTemplate:
+		if payloadTemplate == "" {
+			return p, fmt.Errorf("MQTT payload format 'template' needs a payload_template")
+		}
+
+		t, err := parseMetricTemplate("payload", payloadTemplate)
+		if err != nil {
+			return p, err
+		}
+
+		p.PayloadTemplate = t
+	default:
+		return p, fmt.Errorf("unknown MQTT payload format '%s'", payload)
+	}
+
+	return p, nil
+}
+
+// newMQTTRules returns the configured rules, applied to the defaults
+func newMQTTRules(defaults mqttPublish) ([]mqttRule, error) {
+	rules := []mqttRule{}
+
+	for _, rc := range cfg.MQTT.Rules {
+		if rc.Match == "" {
+			return nil, fmt.Errorf("MQTT rule needs a match")
+		}
+
+		p, err := newMQTTPublish(defaults, rc.QoS, rc.Retain, rc.Payload, rc.PayloadTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("MQTT rule '%s': %w", rc.Match, err)
+		}
+
+		rules = append(rules, mqttRule{Match: rc.Match, mqttPublish: p})
+	}
+
+	return rules, nil
+}
+
+// publishFor returns how to publish to the topic: as the first matching rule
+// says, or else as configured for all topics
+func (s *mqttSink) publishFor(topic string) mqttPublish {
+	for _, r := range s.Rules {
+		if topicMatches(r.Match, topic) {
+			return r.mqttPublish
+		}
+	}
+
+	return s.Publish
+}
+
+// topicMatches tells whether the topic matches the filter, which may use the
+// MQTT wildcards: + for one level, # for all remaining levels
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
+
+// payload formats the metric; switch states are always sent as is, except
+// with a template, and so are undecoded payloads as a plain value
+func (p mqttPublish) payload(m *Metric) string {
+	if p.Payload == mqttPayloadTemplate {
+		var buffer strings.Builder
+
+		if err := p.PayloadTemplate.Execute(&buffer, m); err != nil {
+			log.Errorf("Could not render MQTT payload for '%s': %s", m.ID, err)
+		}
+
+		return buffer.String()
+	}
+
+	if m.State != "" {
+		return m.State
+	}
+
+	if p.Payload == mqttPayloadValue {
+		if m.IsRaw() {
+			return m.Raw
+		}
+
+		return strconv.FormatFloat(m.Value, 'f', -1, 64)
+	}
+
+	u, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+
+	return string(u)
+}
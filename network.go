@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Telnet and RFC 2217 (COM-PORT-OPTION) protocol bytes
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptionBinary  = 0
+	telnetOptionSGA     = 3
+	telnetOptionComPort = 44
+
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+
+	dialTimeout = 10 * time.Second
+)
+
+var comPortParities = map[serial.Parity]byte{
+	serial.ParityNone:  1,
+	serial.ParityOdd:   2,
+	serial.ParityEven:  3,
+	serial.ParityMark:  4,
+	serial.ParitySpace: 5,
+}
+
+// networkReceiver reads frames from a serial port shared over TCP, either
+// as a raw stream or using the telnet based RFC 2217 protocol
+type networkReceiver struct {
+	Address     string
+	RFC2217     bool
+	Config      serial.Config
+	ReadTimeout time.Duration
+}
+
+func newNetworkReceiver(rc receiverConfig) (*networkReceiver, error) {
+	if rc.Address == "" {
+		return nil, fmt.Errorf("address is required for a %s receiver", rc.Type)
+	}
+
+	if _, _, err := net.SplitHostPort(rc.Address); err != nil {
+		return nil, fmt.Errorf("invalid receiver address '%s': %w", rc.Address, err)
+	}
+
+	r := &networkReceiver{
+		Address:     rc.Address,
+		RFC2217:     rc.Type == "rfc2217",
+		ReadTimeout: rc.ReadTimeout,
+	}
+
+	if rc.ReadTimeout < 0 {
+		return nil, fmt.Errorf("read_timeout can not be negative, got %s", rc.ReadTimeout)
+	}
+
+	if r.RFC2217 {
+		c, err := serialConfig(rc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid receiver configuration for '%s': %w", rc.Address, err)
+		}
+
+		r.Config = *c
+	}
+
+	return r, nil
+}
+
+func (r *networkReceiver) String() string {
+	if r.RFC2217 {
+		return "rfc2217://" + r.Address
+	}
+
+	return "tcp://" + r.Address
+}
+
+func (r *networkReceiver) Open() (io.ReadCloser, error) {
+	conn, err := net.DialTimeout("tcp", r.Address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &networkConn{Conn: conn, readTimeout: r.ReadTimeout}
+
+	if !r.RFC2217 {
+		return nc, nil
+	}
+
+	tc := &telnetConn{conn: nc, reader: bufio.NewReader(nc)}
+
+	if err := tc.setup(&r.Config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// networkConn applies the read timeout to every read, so a silent receiver
+// is noticed just like a silent serial port
+type networkConn struct {
+	net.Conn
+	readTimeout time.Duration
+}
+
+func (c *networkConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.Conn.Read(p)
+}
+
+// telnetConn strips telnet commands from the data stream and answers option
+// negotiation, refusing everything but the options it asked for itself
+type telnetConn struct {
+	conn   *networkConn
+	reader *bufio.Reader
+}
+
+func (t *telnetConn) setup(c *serial.Config) error {
+	cmds := [][]byte{
+		{telnetIAC, telnetWILL, telnetOptionComPort},
+		{telnetIAC, telnetWILL, telnetOptionBinary},
+		{telnetIAC, telnetDO, telnetOptionBinary},
+		{telnetIAC, telnetDO, telnetOptionSGA},
+	}
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(c.Baud))
+
+	stopSize := byte(1)
+	if c.StopBits == serial.Stop2 {
+		stopSize = 2
+	}
+
+	cmds = append(cmds,
+		comPortCommand(comPortSetBaudRate, baud...),
+		comPortCommand(comPortSetDataSize, c.Size),
+		comPortCommand(comPortSetParity, comPortParities[c.Parity]),
+		comPortCommand(comPortSetStopSize, stopSize),
+	)
+
+	for _, cmd := range cmds {
+		if _, err := t.conn.Write(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func comPortCommand(cmd byte, value ...byte) []byte {
+	b := []byte{telnetIAC, telnetSB, telnetOptionComPort, cmd}
+
+	for _, v := range value {
+		b = append(b, v)
+		if v == telnetIAC {
+			b = append(b, telnetIAC)
+		}
+	}
+
+	return append(b, telnetIAC, telnetSE)
+}
+
+func (t *telnetConn) Read(p []byte) (int, error) {
+	n := 0
+
+	for n < len(p) {
+		if n > 0 && t.reader.Buffered() == 0 {
+			break
+		}
+
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+
+			return 0, err
+		}
+
+		if b != telnetIAC {
+			p[n] = b
+			n++
+
+			continue
+		}
+
+		literal, err := t.command()
+		if err != nil {
+			return n, err
+		}
+
+		if literal {
+			p[n] = telnetIAC
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// command handles the telnet command following an IAC, and returns whether
+// it was an escaped IAC data byte
+func (t *telnetConn) command() (bool, error) {
+	cmd, err := t.reader.ReadByte()
+	if err != nil {
+		return false, err
+	}
+
+	switch cmd {
+	case telnetIAC:
+		return true, nil
+	case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+		option, err := t.reader.ReadByte()
+		if err != nil {
+			return false, err
+		}
+
+		return false, t.negotiate(cmd, option)
+	case telnetSB:
+		// Notifications from the server, eg. line or modem state changes
+		return false, t.skipSubnegotiation()
+	default:
+		return false, nil
+	}
+}
+
+func (t *telnetConn) negotiate(cmd, option byte) error {
+	switch {
+	case cmd == telnetWONT && option == telnetOptionComPort,
+		cmd == telnetDONT && option == telnetOptionComPort:
+		log.Warnf("Receiver '%s' refused RFC 2217, serial settings are not applied", t.conn.RemoteAddr())
+	case cmd == telnetDO && option != telnetOptionComPort && option != telnetOptionBinary:
+		_, err := t.conn.Write([]byte{telnetIAC, telnetWONT, option})
+		return err
+	case cmd == telnetWILL && option != telnetOptionBinary && option != telnetOptionSGA:
+		_, err := t.conn.Write([]byte{telnetIAC, telnetDONT, option})
+		return err
+	}
+
+	return nil
+}
+
+func (t *telnetConn) skipSubnegotiation() error {
+	for {
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b != telnetIAC {
+			continue
+		}
+
+		b, err = t.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b == telnetSE {
+			return nil
+		}
+	}
+}
+
+func (t *telnetConn) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	defaultQueueSize = 1000
+
+	overflowDropOldest = "drop_oldest"
+	overflowDropNewest = "drop_newest"
+	overflowSpill      = "spill"
+)
+
+// metricQueue is the bounded queue in front of a sink; Push never blocks,
+// when the queue is full the overflow policy decides what happens
+type metricQueue struct {
+	sync.Mutex
+	space    *sync.Cond
+	name     string
+	size     int
+	overflow string
+	items    []*Metric
+	spill    *diskQueue
+	closed   bool
+	notify   chan struct{}
+}
+
+func newMetricQueue(name string, qc queueConfig) (*metricQueue, error) {
+	q := &metricQueue{
+		name:     name,
+		size:     qc.Size,
+		overflow: qc.Overflow,
+		notify:   make(chan struct{}, 1),
+	}
+
+	q.space = sync.NewCond(&q.Mutex)
+
+	if q.size <= 0 {
+		q.size = defaultQueueSize
+	}
+
+	switch q.overflow {
+	case "":
+		q.overflow = overflowDropOldest
+	case overflowDropOldest, overflowDropNewest:
+	case overflowSpill:
+		if qc.Directory == "" {
+			return nil, fmt.Errorf("queue for '%s' needs a directory to spill to", name)
+		}
+
+		if err := os.MkdirAll(qc.Directory, 0755); err != nil {
+			return nil, err
+		}
+
+		spill, err := openDiskQueue(name, filepath.Join(qc.Directory, name+".spill"), qc.MaxSize, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		q.spill = spill
+	default:
+		return nil, fmt.Errorf("unknown overflow policy '%s' for '%s'", qc.Overflow, name)
+	}
+
+	return q, nil
+}
+
+func (q *metricQueue) stat(name string) string {
+	return "sink." + q.name + "." + name
+}
+
+func (q *metricQueue) Push(m *Metric) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.push(m)
+}
+
+// PushWait waits for room in the queue instead of applying the overflow
+// policy, for input that can wait such as a replayed recording
+func (q *metricQueue) PushWait(m *Metric) {
+	q.Lock()
+	defer q.Unlock()
+
+	for !q.closed && q.spill == nil && len(q.items) >= q.size {
+		q.space.Wait()
+	}
+
+	q.push(m)
+}
+
+func (q *metricQueue) push(m *Metric) {
+	if q.closed {
+		return
+	}
+
+	switch {
+	case q.spill != nil && (q.spill.Len() > 0 || len(q.items) >= q.size):
+		// Once spilling, everything goes to disk to keep the order
+		if err := q.spill.Push([]*Metric{m}); err != nil {
+			stats.Inc(q.stat("dropped"))
+			log.Errorf("Could not spill metric for '%s': %s", q.name, err)
+		} else {
+			stats.Inc(q.stat("spilled"))
+		}
+	case len(q.items) < q.size:
+		q.items = append(q.items, m)
+	case q.overflow == overflowDropNewest:
+		stats.Inc(q.stat("dropped"))
+	default:
+		q.items = append(q.items[1:], m)
+		stats.Inc(q.stat("dropped"))
+	}
+
+	q.signal()
+}
+
+func (q *metricQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pop takes up to n metrics; the second return value is false once the
+// queue is closed and empty
+func (q *metricQueue) Pop(n int) ([]*Metric, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.items) < n {
+		q.refill()
+	}
+
+	if n > len(q.items) {
+		n = len(q.items)
+	}
+
+	batch := make([]*Metric, n)
+	copy(batch, q.items)
+	q.items = q.items[n:]
+
+	if n > 0 {
+		q.space.Broadcast()
+	}
+
+	stats.Set(q.stat("queued"), float64(q.len()))
+
+	if len(q.items) > 0 {
+		q.signal()
+	}
+
+	return batch, n > 0 || !q.closed
+}
+
+// refill moves spilled metrics back into memory as long as there is room
+func (q *metricQueue) refill() {
+	if q.spill == nil || q.spill.Len() == 0 {
+		return
+	}
+
+	metrics, err := q.spill.Pop(q.size - len(q.items))
+	if err != nil {
+		log.Errorf("Could not read spilled metrics for '%s': %s", q.name, err)
+	}
+
+	q.items = append(q.items, metrics...)
+}
+
+func (q *metricQueue) len() int {
+	if q.spill == nil {
+		return len(q.items)
+	}
+
+	return len(q.items) + q.spill.Len()
+}
+
+func (q *metricQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.len()
+}
+
+func (q *metricQueue) Closed() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.closed
+}
+
+// Close stops accepting metrics; what is queued can still be popped
+func (q *metricQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	q.signal()
+	q.space.Broadcast()
+}
+
+// Release closes the spill file, keeping whatever was not sent for the
+// next run
+func (q *metricQueue) Release() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.spill == nil {
+		return nil
+	}
+
+	return q.spill.Close()
+}
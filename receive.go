@@ -1,106 +1,127 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"strconv"
-	"strings"
-
-	"github.com/tarm/serial"
+	"time"
 )
 
 type Metric struct {
-	Name  string  `json:"name"`
-	Type  string  `json:"type"`
-	Value float64 `json:"value"`
+	Name      string    `json:"name"`
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Value     float64   `json:"value"`
+	State     string    `json:"state,omitempty"`
+	Raw       string    `json:"raw,omitempty"`
+	Undecoded bool      `json:"undecoded,omitempty"`
+	Family    string    `json:"family,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	Receiver  string    `json:"receiver"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
-func newTTYReceiver() *serial.Port {
-	portStr := cfg.Receiver.PortStr
-	baudRate := cfg.Receiver.BaudRate
+// line is a single line as read from a receiver
+type line struct {
+	Receiver *receiverConfig
+	Text     string
+	Received time.Time
 
-	if err := resetTTY(portStr, baudRate); err != nil {
-		log.Fatal("An error has occurred while resetting tty:", err)
-		os.Exit(1)
-	}
+	// Finite is set for lines from a finite receiver, which rather waits
+	// for the sinks than have its metrics dropped
+	Finite bool
+}
 
-	sif, err := serial.OpenPort(&serial.Config{Name: portStr, Baud: baudRate})
-	if err != nil {
-		log.Fatal("An error has occurred while trying to open the tty:", err)
-		os.Exit(1)
-	}
+// IsRaw tells whether the payload could not be decoded, so there is no value
+// but only the raw bytes (if there were any)
+func (m *Metric) IsRaw() bool {
+	return m.Undecoded
+}
+
+// parseInput sends the metrics of every line to the sinks, until the input
+// is closed or a signal arrives on quit
+func parseInput(input chan *line, quit <-chan os.Signal, sinks []*sinkRunner) {
+	ticker := time.NewTicker(cfg.Stats.interval())
+	defer ticker.Stop()
 
-	return sif
+	for {
+		select {
+		case sig := <-quit:
+			log.Printf("Received %s, stopping", sig)
+			sendMetrics(stats.Metrics(cfg.Stats.name(), time.Now()), sinks, false)
+
+			return
+		case l, ok := <-input:
+			if !ok {
+				sendMetrics(stats.Metrics(cfg.Stats.name(), time.Now()), sinks, false)
+				return
+			}
+
+			log.WithField("receiver", l.Receiver.Name).Printf("Received: %s", l.Text)
+
+			sendMetrics(parseMessage(l), sinks, l.Finite)
+		case <-ticker.C:
+			sendMetrics(stats.Metrics(cfg.Stats.name(), time.Now()), sinks, false)
+		}
+	}
 }
 
-func resetTTY(portStr string, baudRate int) error {
-	binary, err := exec.LookPath("stty")
+func parseMessage(l *line) []*Metric {
+	f, err := parseFrame(l.Text, l.Received)
 	if err != nil {
-		return err
+		stats.Inc("frames.rejected." + rejectReason(err, "invalid"))
+		log.Errorf("Rejected frame '%s' from '%s': %s", l.Text, l.Receiver.Name, err)
+
+		return nil
 	}
 
-	args := []string{"-F", portStr, strconv.Itoa(baudRate), "-hup", "raw", "-echo"}
+	f.Receiver = l.Receiver.Name
 
-	if _, err = exec.Command(binary, args...).Output(); err != nil {
-		return err
-	}
+	if !f.OK() {
+		stats.Inc(fmt.Sprintf("frames.status.%d", f.Status))
+		log.Errorf("Receiver reported status %d for '%s'", f.Status, f.ID)
 
-	return nil
-}
+		return nil
+	}
 
-func readFromTTY(sif io.Reader, ttyInput chan string) error {
-	var message string
-	var err error
-	reader := bufio.NewReader(sif)
+	if isDuplicate(l.Receiver.Name, f) {
+		stats.Inc("frames.duplicates")
+		log.Debugf("Dropped duplicate frame '%s' from '%s'", l.Text, l.Receiver.Name)
 
-	for {
-		message, err = reader.ReadString('\n')
-		if err != nil {
-			return err
-		}
+		return nil
+	}
 
-		ttyInput <- strings.TrimSpace(message)
+	metrics, err := decodePayload(f)
+	if err != nil {
+		stats.Inc("frames.rejected." + rejectReason(err, "decode"))
+		log.Errorf("Could not decode payload for '%s': %s", f.ID, err)
 	}
-}
 
-func parseInput(input chan string, outputs ...chan *Metric) {
-	for {
-		message := <-input
-
-		log.Printf("Received: %s", message)
-
-		data := strings.Split(message, " ")
-		/****
-		Following information is calculated by tty but not used
-		status := data[0]
-		timestamp := data[1]
-		****/
-		id, _ := stringsToIntegerHexes(data[2:10])
-		payload, _ := stringsToIntegers(data[10:])
-		name := idToName(id)
-
-		var (
-			pType  string
-			pValue float64
-		)
-
-		if strings.HasPrefix(id, "0000") {
-			pType, pValue = payloadNode(payload)
-		} else if strings.HasPrefix(id, "28") {
-			pType, pValue = payloadDS18B20(payload)
-		} else {
-			pType = "unknown"
-			pValue = 0
-		}
+	name := idToName(l.Receiver, f.ID)
+	node := nodeFor(l.Receiver, f.ID)
+
+	for _, m := range metrics {
+		m.Name = name
+		m.ID = f.ID
+		m.Family = fmt.Sprintf("%02x", f.Family)
+		m.Node = node
+		m.Receiver = l.Receiver.Name
+		m.Timestamp = f.Timestamp
+	}
 
-		m := Metric{Name: name, Type: pType, Value: pValue}
+	return metrics
+}
 
-		for _, o := range outputs {
-			o <- &m
+// sendMetrics queues the metrics for every sink; with wait, it waits for
+// room in the queues instead of dropping metrics
+func sendMetrics(metrics []*Metric, sinks []*sinkRunner, wait bool) {
+	for _, m := range metrics {
+		for _, s := range sinks {
+			if wait {
+				s.SendWait(m)
+			} else {
+				s.Send(m)
+			}
 		}
 	}
 }
@@ -119,57 +140,3 @@ func stringsToIntegers(integerStrings []string) ([]int, error) {
 
 	return ints, nil
 }
-
-func stringsToIntegerHexes(integerStrings []string) (string, error) {
-	var buffer bytes.Buffer
-
-	for _, i := range integerStrings {
-		j, err := strconv.Atoi(i)
-		if err != nil {
-			return buffer.String(), err
-		}
-
-		buffer.WriteString(fmt.Sprintf("%02x", j))
-	}
-
-	return buffer.String(), nil
-}
-
-func payloadNode(payload []int) (string, float64) {
-	payloadTypeInt := payload[0]
-	payloadType := "unknown"
-
-	if payloadTypeInt == 1 {
-		payloadType = "heartbeat"
-	}
-
-	payloadValue := 0
-
-	for i := len(payload) - 1; i >= 1; i-- {
-		payloadValue = payloadValue<<8 + payload[i]
-	}
-
-	return payloadType, float64(payloadValue)
-}
-
-func payloadDS18B20(payload []int) (string, float64) {
-	low := payload[0]
-	high := payload[1]
-
-	high = high << 8
-	t := high + low
-
-	sign := t & 32768
-
-	var s int
-	if sign == 0 {
-		s = 1
-	} else {
-		s = -1
-		t = (t ^ 65535) + 1
-	}
-
-	temp := float64(s*t) / 16.0
-
-	return "temperature", temp
-}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// receiver is a source of frames, such as a serial port or a network
+// connection to one
+type receiver interface {
+	Open() (io.ReadCloser, error)
+	String() string
+}
+
+// finite is implemented by receivers that are not reopened once they end,
+// such as a replayed recording
+type finite interface {
+	Finite() bool
+}
+
+func isFinite(r receiver) bool {
+	f, ok := r.(finite)
+	return ok && f.Finite()
+}
+
+func newReceiver(rc receiverConfig) (receiver, error) {
+	switch rc.Type {
+	case "", "serial":
+		return newTTYReceiver(rc)
+	case "tcp", "rfc2217":
+		return newNetworkReceiver(rc)
+	case "replay":
+		return newReplayReceiver(rc)
+	case "simulator":
+		return newSimulatorReceiver(rc)
+	default:
+		return nil, fmt.Errorf("unknown receiver type '%s'", rc.Type)
+	}
+}
+
+// readFromReceiver keeps the receiver open, and reopens it with an increasing
+// delay whenever it could not be opened or reading from it failed; a finite
+// receiver is read only once
+func readFromReceiver(rc *receiverConfig, r receiver, ttyInput chan *line) {
+	connected := "receiver." + rc.Name + ".connected"
+
+	delay := minReconnectDelay
+
+	var lostAt time.Time
+
+	for {
+		port, err := r.Open()
+		if err != nil && isFinite(r) {
+			log.Errorf("Could not open receiver '%s': %s", r, err)
+			return
+		}
+
+		if err != nil {
+			stats.Set(connected, 0)
+			log.Errorf("Could not open receiver '%s', retrying in %s: %s", r, delay, err)
+
+			time.Sleep(delay)
+
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+
+			continue
+		}
+
+		stats.Set(connected, 1)
+
+		if lostAt.IsZero() {
+			log.Printf("Opened receiver '%s'", r)
+		} else {
+			log.Printf("Reopened receiver '%s' after an outage of %s", r, time.Since(lostAt).Round(time.Second))
+		}
+
+		delay = minReconnectDelay
+		err = readLines(rc, port, isFinite(r), ttyInput)
+
+		port.Close()
+
+		// A finite receiver is never reopened, as that would start it over
+		if isFinite(r) {
+			stats.Set(connected, 0)
+
+			if err == io.EOF {
+				log.Printf("Receiver '%s' has ended", r)
+			} else {
+				log.Errorf("Receiver '%s' has ended early: %s", r, err)
+			}
+
+			return
+		}
+
+		lostAt = time.Now()
+
+		stats.Set(connected, 0)
+		stats.Inc("receiver." + rc.Name + ".disconnects")
+		log.Errorf("Lost receiver '%s': %s", r, err)
+	}
+}
+
+// readLines sends every line read to ttyInput, until reading fails; the end of
+// the input is returned as io.EOF
+func readLines(rc *receiverConfig, sif io.Reader, finite bool, ttyInput chan *line) error {
+	reader := bufio.NewReader(sif)
+
+	for {
+		message, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		message = strings.TrimSpace(message)
+		if message == "" {
+			continue
+		}
+
+		l := &line{Receiver: rc, Text: message, Received: time.Now(), Finite: finite}
+		capture.Write(rc.Name, l.Received, l.Text)
+
+		ttyInput <- l
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const receivedPrefix = "Received: "
+
+// logTime finds the time logged by logrus' text formatter
+var logTime = regexp.MustCompile(`time="([^"]+)"`)
+
+// replayReceiver feeds a recording (a file or stdin) through the pipeline,
+// either as fast as possible or paced by the frame timestamps
+type replayReceiver struct {
+	Path   string
+	Format string
+	Speed  float64
+}
+
+func newReplayReceiver(rc receiverConfig) (*replayReceiver, error) {
+	if rc.Path == "" {
+		return nil, fmt.Errorf("path is required for a replay receiver")
+	}
+
+	switch rc.Format {
+	case "", "raw", "log", "capture":
+	default:
+		return nil, fmt.Errorf("unknown replay format '%s'", rc.Format)
+	}
+
+	if rc.Speed < 0 {
+		return nil, fmt.Errorf("speed can not be negative, got %f", rc.Speed)
+	}
+
+	return &replayReceiver{Path: rc.Path, Format: rc.Format, Speed: rc.Speed}, nil
+}
+
+func (r *replayReceiver) String() string {
+	return "replay:" + r.Path
+}
+
+// Finite tells readFromReceiver not to reopen the recording once it ends
+func (r *replayReceiver) Finite() bool {
+	return true
+}
+
+func (r *replayReceiver) Open() (io.ReadCloser, error) {
+	var file io.ReadCloser = io.NopCloser(os.Stdin)
+
+	if r.Path != "-" {
+		f, err := os.Open(r.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		file = f
+	}
+
+	return &replayReader{receiver: r, file: file, scanner: bufio.NewScanner(file)}, nil
+}
+
+type replayReader struct {
+	receiver *replayReceiver
+	file     io.ReadCloser
+	scanner  *bufio.Scanner
+	previous time.Time
+	buffer   []byte
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return 0, err
+			}
+
+			return 0, io.EOF
+		}
+
+		message, ok := r.frame(r.scanner.Text())
+		if !ok {
+			continue
+		}
+
+		r.buffer = []byte(message + "\n")
+	}
+
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+
+	return n, nil
+}
+
+func (r *replayReader) Close() error {
+	return r.file.Close()
+}
+
+// frame extracts the frame from a recorded line, and waits until it is time
+// to replay it
+func (r *replayReader) frame(text string) (string, bool) {
+	var logged time.Time
+
+	if r.receiver.Format == "log" {
+		i := strings.Index(text, receivedPrefix)
+		if i < 0 {
+			return "", false
+		}
+
+		if m := logTime.FindStringSubmatch(text); m != nil {
+			logged, _ = time.Parse(time.RFC3339, m[1])
+		}
+
+		text = text[i+len(receivedPrefix):]
+		if j := strings.IndexByte(text, '"'); j >= 0 {
+			text = text[:j]
+		}
+	}
+
+	if r.receiver.Format == "capture" {
+		// <time> <receiver> <frame>
+		parts := strings.SplitN(text, " ", 3)
+		if len(parts) < 3 {
+			return "", false
+		}
+
+		logged, _ = time.Parse(time.RFC3339Nano, parts[0])
+		text = parts[2]
+	}
+
+	data := strings.Fields(text)
+	if len(data) < 2 {
+		return text, true
+	}
+
+	// Without a timestamp from the receiver, the logged time is the best
+	// guess of when the frame was received
+	ts, err := strconv.ParseInt(data[1], 10, 64)
+	if (err != nil || ts < minFrameTimestamp) && !logged.IsZero() {
+		ts = logged.Unix()
+		data[1] = strconv.FormatInt(ts, 10)
+	}
+
+	if ts >= minFrameTimestamp {
+		r.wait(time.Unix(ts, 0))
+	}
+
+	return strings.Join(data, " "), true
+}
+
+func (r *replayReader) wait(at time.Time) {
+	if r.receiver.Speed > 0 && !r.previous.IsZero() && at.After(r.previous) {
+		time.Sleep(time.Duration(float64(at.Sub(r.previous)) / r.receiver.Speed))
+	}
+
+	r.previous = at
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const defaultSimulationInterval = 10 * time.Second
+
+type simulatedSensor struct {
+	ROM         []byte
+	Temperature float64
+}
+
+type simulatedNode struct {
+	ROM     []byte
+	Sensors []*simulatedSensor
+}
+
+// simulatorReceiver generates frames for a configured set of nodes and
+// DS18B20 sensors, so the pipeline can be used without a receiver attached
+type simulatorReceiver struct {
+	Interval time.Duration
+	Corrupt  float64
+	Dropout  float64
+	Nodes    []*simulatedNode
+	rand     *rand.Rand
+	cycle    int
+}
+
+func newSimulatorReceiver(rc receiverConfig) (*simulatorReceiver, error) {
+	sc := rc.Simulation
+
+	r := &simulatorReceiver{
+		Interval: sc.Interval,
+		Corrupt:  sc.Corrupt,
+		Dropout:  sc.Dropout,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if r.Interval <= 0 {
+		r.Interval = defaultSimulationInterval
+	}
+
+	if r.Corrupt < 0 || r.Corrupt > 1 || r.Dropout < 0 || r.Dropout > 1 {
+		return nil, fmt.Errorf("corrupt and dropout must be between 0 and 1")
+	}
+
+	if len(sc.Nodes) == 0 {
+		return nil, fmt.Errorf("a simulator receiver needs at least one node")
+	}
+
+	for _, nc := range sc.Nodes {
+		rom, err := simulatedROM(nc.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if rom[0] != familyNode {
+			return nil, fmt.Errorf("simulated node '%s' is not a node id", nc.ID)
+		}
+
+		n := &simulatedNode{ROM: rom}
+
+		for _, id := range nc.Sensors {
+			rom, err := simulatedROM(id)
+			if err != nil {
+				return nil, err
+			}
+
+			if rom[0] != 0x28 {
+				return nil, fmt.Errorf("simulated sensor '%s' is not a DS18B20", id)
+			}
+
+			if crc8(bytesToIntegers(rom[:frameIDSize-1])) != int(rom[frameIDSize-1]) {
+				return nil, fmt.Errorf("simulated sensor '%s' has an invalid CRC", id)
+			}
+
+			n.Sensors = append(n.Sensors, &simulatedSensor{ROM: rom, Temperature: 15 + r.rand.Float64()*10})
+		}
+
+		r.Nodes = append(r.Nodes, n)
+	}
+
+	return r, nil
+}
+
+func simulatedROM(id string) ([]byte, error) {
+	rom, err := hex.DecodeString(id)
+	if err != nil || len(rom) != frameIDSize {
+		return nil, fmt.Errorf("invalid simulated id '%s'", id)
+	}
+
+	return rom, nil
+}
+
+func (r *simulatorReceiver) String() string {
+	return "simulator"
+}
+
+func (r *simulatorReceiver) Open() (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+
+	go r.run(pw)
+
+	return pr, nil
+}
+
+// run writes a cycle of frames every interval, until the reading end is
+// closed
+func (r *simulatorReceiver) run(w *io.PipeWriter) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, text := range r.frames(time.Now()) {
+			if _, err := io.WriteString(w, text+"\n"); err != nil {
+				return
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+func (r *simulatorReceiver) frames(at time.Time) []string {
+	r.cycle++
+
+	frames := []string{}
+
+	for _, n := range r.Nodes {
+		heartbeat := []byte{1, byte(r.cycle), byte(r.cycle >> 8)}
+		frames = append(frames, simulatedFrame(at, n.ROM, heartbeat))
+
+		for _, s := range n.Sensors {
+			// Drift slowly, but stay within a realistic range
+			s.Temperature = math.Max(-10, math.Min(40, s.Temperature+r.rand.NormFloat64()*0.1))
+			frames = append(frames, simulatedFrame(at, s.ROM, ds18b20Scratchpad(s.Temperature)))
+		}
+	}
+
+	result := []string{}
+
+	for _, f := range frames {
+		if r.rand.Float64() < r.Dropout {
+			continue
+		}
+
+		if r.rand.Float64() < r.Corrupt {
+			f = r.corrupt(f)
+		}
+
+		result = append(result, f)
+	}
+
+	return result
+}
+
+func (r *simulatorReceiver) corrupt(text string) string {
+	fields := strings.Fields(text)
+
+	switch r.rand.Intn(3) {
+	case 0:
+		// Truncated line
+		return strings.Join(fields[:r.rand.Intn(len(fields))], " ")
+	case 1:
+		// Flipped bits in one of the bytes
+		i := 2 + r.rand.Intn(len(fields)-2)
+		fields[i] = fmt.Sprintf("%d", r.rand.Intn(256))
+	default:
+		// Garbage from the radio
+		fields[2+r.rand.Intn(len(fields)-2)] = "x"
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func simulatedFrame(at time.Time, rom []byte, payload []byte) string {
+	fields := []string{"0", fmt.Sprintf("%d", at.Unix())}
+
+	for _, b := range append(append([]byte{}, rom...), payload...) {
+		fields = append(fields, fmt.Sprintf("%d", b))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func ds18b20Scratchpad(temp float64) []byte {
+	raw := uint16(int16(math.Round(temp * 16)))
+	scratchpad := []byte{byte(raw), byte(raw >> 8), 0x4b, 0x46, 0x7f, 0xff, 0x0c, 0x10}
+
+	return append(scratchpad, byte(crc8(bytesToIntegers(scratchpad))))
+}
+
+func bytesToIntegers(data []byte) []int {
+	ints := make([]int, len(data))
+
+	for i, b := range data {
+		ints[i] = int(b)
+	}
+
+	return ints
+}
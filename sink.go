@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultSinkBatchSize = 100
+	sinkFlushInterval    = 10 * time.Second
+)
+
+// Sink is an output for metrics, such as graphite or MQTT
+type Sink interface {
+	// Start prepares the sink, eg. by connecting to its backend
+	Start() error
+	// Write sends a batch of metrics
+	Write(metrics []*Metric) error
+	// Flush sends anything the sink may have buffered itself
+	Flush() error
+	// Close flushes and releases the sink
+	Close() error
+	// Health returns why the sink is not healthy, or nil
+	Health() error
+}
+
+var sinkFactories = map[string]func() (Sink, error){
+	"graphite": newGraphiteSink,
+	"log":      newLogSink,
+	"mqtt":     newMQTTSink,
+}
+
+// enabledSinks returns the configured sinks; without a list, every sink that
+// has a host configured is enabled
+func enabledSinks() []string {
+	if len(cfg.Sinks) > 0 {
+		return cfg.Sinks
+	}
+
+	names := []string{}
+
+	if cfg.Graphite.Configuration.Host != "" {
+		names = append(names, "graphite")
+	}
+
+	if cfg.MQTT.Host != "" {
+		names = append(names, "mqtt")
+	}
+
+	return names
+}
+
+func newSink(name string) (Sink, error) {
+	factory, ok := sinkFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink '%s'", name)
+	}
+
+	return factory()
+}
+
+// parseMetricTemplate parses a template that is rendered for every metric
+func parseMetricTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	// Catch references to unknown fields now rather than for every metric
+	if err := t.Execute(io.Discard, &Metric{}); err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	return t, nil
+}
+
+// sinkRunner feeds the metrics to a sink from its own goroutine, through a
+// queue so a slow or hanging sink does not hold up the others
+type sinkRunner struct {
+	Name  string
+	sink  Sink
+	queue *metricQueue
+	done  chan struct{}
+
+	// Metrics are written once batchSize of them are queued, or every
+	// batchInterval; without an interval they are written right away
+	batchSize     int
+	batchInterval time.Duration
+
+	// Optional write-ahead queue for metrics the sink could not take, and
+	// when to try replaying it next
+	wal     *diskQueue
+	retryAt time.Time
+}
+
+func startSink(name string) (*sinkRunner, error) {
+	s, err := newSink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	qc := cfg.Queues[name]
+
+	q, err := newMetricQueue(name, qc)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &sinkRunner{
+		Name:          name,
+		sink:          s,
+		queue:         q,
+		done:          make(chan struct{}),
+		batchSize:     qc.BatchSize,
+		batchInterval: qc.BatchInterval,
+	}
+
+	if r.batchSize <= 0 {
+		r.batchSize = defaultSinkBatchSize
+	}
+
+	if qc.Persistent {
+		if r.wal, err = openWAL(name, qc); err != nil {
+			q.Release()
+			return nil, err
+		}
+
+		if r.wal.Len() > 0 {
+			log.Printf("Sink '%s' has %d undelivered metrics from a previous run", name, r.wal.Len())
+		}
+	}
+
+	if err := s.Start(); err != nil {
+		r.release()
+		return nil, fmt.Errorf("could not start sink '%s': %w", name, err)
+	}
+
+	go r.run()
+
+	return r, nil
+}
+
+// Send queues the metric for the sink; it never blocks
+func (r *sinkRunner) Send(m *Metric) {
+	r.queue.Push(m)
+}
+
+// SendWait queues the metric for the sink, waiting for room in its queue
+func (r *sinkRunner) SendWait(m *Metric) {
+	r.queue.PushWait(m)
+}
+
+// Stop sends the remaining metrics and closes the sink
+func (r *sinkRunner) Stop() {
+	r.queue.Close()
+	<-r.done
+}
+
+func (r *sinkRunner) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(sinkFlushInterval)
+	defer ticker.Stop()
+
+	var batchTick <-chan time.Time
+
+	if r.batchInterval > 0 {
+		t := time.NewTicker(r.batchInterval)
+		defer t.Stop()
+
+		batchTick = t.C
+	}
+
+	for {
+		select {
+		case <-r.queue.notify:
+			if r.batchInterval > 0 && r.queue.Len() < r.batchSize && !r.queue.Closed() {
+				continue
+			}
+
+			if !r.drain() {
+				r.close()
+				return
+			}
+		case <-batchTick:
+			if !r.drain() {
+				r.close()
+				return
+			}
+		case <-ticker.C:
+			r.replay()
+
+			if err := r.sink.Flush(); err != nil {
+				stats.Inc("sink." + r.Name + ".errors")
+				log.Errorf("Could not flush sink '%s': %s", r.Name, err)
+			}
+
+			r.updateHealth()
+		}
+	}
+}
+
+// drain writes batches until the queue is empty, and returns false once the
+// queue is closed
+func (r *sinkRunner) drain() bool {
+	for {
+		batch, open := r.queue.Pop(r.batchSize)
+		if len(batch) > 0 {
+			r.write(batch)
+		}
+
+		if !open {
+			return false
+		}
+
+		if len(batch) == 0 {
+			return true
+		}
+	}
+}
+
+func (r *sinkRunner) close() {
+	if err := r.sink.Close(); err != nil {
+		log.Errorf("Could not close sink '%s': %s", r.Name, err)
+	}
+
+	r.release()
+}
+
+func (r *sinkRunner) release() {
+	if err := r.queue.Release(); err != nil {
+		log.Errorf("Could not close the queue of sink '%s': %s", r.Name, err)
+	}
+
+	if r.wal == nil {
+		return
+	}
+
+	if err := r.wal.Close(); err != nil {
+		log.Errorf("Could not close the write-ahead queue of sink '%s': %s", r.Name, err)
+	}
+}
+
+// write sends the metrics to the sink; with a write-ahead queue, metrics that
+// could not be sent are stored, and newer metrics are queued behind them to
+// keep the order
+func (r *sinkRunner) write(metrics []*Metric) {
+	defer r.updateHealth()
+
+	if r.wal != nil && r.wal.Len() > 0 {
+		r.persist(metrics)
+
+		if !time.Now().Before(r.retryAt) {
+			r.replay()
+		}
+
+		return
+	}
+
+	if err := r.sink.Write(metrics); err != nil {
+		stats.Inc("sink." + r.Name + ".errors")
+		log.Errorf("Could not write %d metrics to sink '%s': %s", len(metrics), r.Name, err)
+
+		if r.wal != nil {
+			r.persist(metrics)
+			r.retryAt = time.Now().Add(sinkFlushInterval)
+		}
+	}
+}
+
+func (r *sinkRunner) persist(metrics []*Metric) {
+	if err := r.wal.Push(metrics); err != nil {
+		stats.Inc("sink." + r.Name + ".dropped")
+		log.Errorf("Could not store %d metrics for sink '%s': %s", len(metrics), r.Name, err)
+	}
+
+	stats.Set("sink."+r.Name+".undelivered", float64(r.wal.Len()))
+}
+
+// replay sends the stored metrics in order, until the queue is empty or the
+// sink fails again
+func (r *sinkRunner) replay() {
+	if r.wal == nil || r.wal.Len() == 0 {
+		return
+	}
+
+	defer func() {
+		stats.Set("sink."+r.Name+".undelivered", float64(r.wal.Len()))
+	}()
+
+	for r.wal.Len() > 0 {
+		batch, err := r.wal.Peek(r.batchSize)
+		if err != nil {
+			log.Errorf("Could not read the write-ahead queue of sink '%s': %s", r.Name, err)
+			return
+		}
+
+		if len(batch) > 0 {
+			if err := r.sink.Write(batch); err != nil {
+				r.retryAt = time.Now().Add(sinkFlushInterval)
+				log.Errorf("Could not replay %d metrics to sink '%s': %s", len(batch), r.Name, err)
+
+				return
+			}
+		}
+
+		if err := r.wal.Commit(); err != nil {
+			log.Errorf("Could not update the write-ahead queue of sink '%s': %s", r.Name, err)
+			return
+		}
+	}
+
+	log.Printf("Sink '%s' has delivered all stored metrics", r.Name)
+}
+
+func openWAL(name string, qc queueConfig) (*diskQueue, error) {
+	if qc.Directory == "" {
+		return nil, fmt.Errorf("queue for '%s' needs a directory to persist to", name)
+	}
+
+	if err := os.MkdirAll(qc.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	wal, err := openDiskQueue(name, filepath.Join(qc.Directory, name+".wal"), qc.MaxSize, qc.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	wal.sync = true
+
+	return wal, nil
+}
+
+func (r *sinkRunner) updateHealth() {
+	healthy := 1.0
+	if r.sink.Health() != nil {
+		healthy = 0
+	}
+
+	stats.Set("sink."+r.Name+".healthy", healthy)
+}
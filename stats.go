@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// statistics keeps the daemon's own counters and gauges, which are
+// periodically sent to the outputs like any other metric
+type statistics struct {
+	sync.Mutex
+	values map[string]float64
+}
+
+var stats = &statistics{values: map[string]float64{}}
+
+func (s *statistics) Inc(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.values[name]++
+}
+
+func (s *statistics) Set(name string, value float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.values[name] = value
+}
+
+func (s *statistics) Metrics(name string, at time.Time) []*Metric {
+	s.Lock()
+	defer s.Unlock()
+
+	metrics := make([]*Metric, 0, len(s.values))
+
+	for t, v := range s.values {
+		metrics = append(metrics, &Metric{Name: name, Type: t, Value: v, Timestamp: at})
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Type < metrics[j].Type })
+
+	return metrics
+}
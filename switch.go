@@ -0,0 +1,40 @@
+package main
+
+import "fmt"
+
+func stateMetric(name string, on bool) *Metric {
+	if on {
+		return &Metric{Type: name, Value: 1, State: "ON"}
+	}
+
+	return &Metric{Type: name, Value: 0, State: "OFF"}
+}
+
+// payloadDS2408 decodes the PIO logic state register into pio0..pio7
+func payloadDS2408(f *frame) ([]*Metric, error) {
+	payload := f.Payload
+
+	metrics := []*Metric{}
+
+	for i := 0; i < 8; i++ {
+		metrics = append(metrics, stateMetric(fmt.Sprintf("pio%d", i), payload[0]&(1<<i) != 0))
+	}
+
+	return metrics, nil
+}
+
+// payloadDS2413 decodes the PIO access read byte into pio0 (PIOA) and pio1
+// (PIOB); the upper nibble must be the complement of the lower nibble
+func payloadDS2413(f *frame) ([]*Metric, error) {
+	payload := f.Payload
+
+	b := payload[0]
+	if b>>4 != ^b&0x0f {
+		return nil, fmt.Errorf("DS2413 status byte 0x%02x fails complement check", b)
+	}
+
+	return []*Metric{
+		stateMetric("pio0", b&0x01 != 0),
+		stateMetric("pio1", b&0x04 != 0),
+	}, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Longest read timeout the serial package supports outside of Windows
+const maxPosixReadTimeout = 25500 * time.Millisecond
+
+// Baud rates the serial package can set up (on Linux)
+var baudRates = map[int]bool{
+	50: true, 75: true, 110: true, 134: true, 150: true, 200: true, 300: true, 600: true,
+	1200: true, 1800: true, 2400: true, 4800: true, 9600: true, 19200: true, 38400: true,
+	57600: true, 115200: true, 230400: true, 460800: true, 500000: true, 576000: true,
+	921600: true, 1000000: true, 1152000: true, 1500000: true, 2000000: true, 2500000: true,
+	3000000: true, 3500000: true, 4000000: true,
+}
+
+// Parity values as used in the configuration
+var parities = map[int]serial.Parity{
+	0: serial.ParityNone,
+	1: serial.ParityOdd,
+	2: serial.ParityEven,
+	3: serial.ParityMark,
+	4: serial.ParitySpace,
+}
+
+type ttyReceiver struct {
+	PortStr string
+	Config  serial.Config
+}
+
+func newTTYReceiver(rc receiverConfig) (*ttyReceiver, error) {
+	if rc.PortStr == "" {
+		return nil, fmt.Errorf("port_str is required for a serial receiver")
+	}
+
+	c, err := serialConfig(rc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid receiver configuration for '%s': %w", rc.PortStr, err)
+	}
+
+	if (c.Parity == serial.ParityMark || c.Parity == serial.ParitySpace) && runtime.GOOS != "windows" {
+		return nil, fmt.Errorf("mark and space parity are not supported on %s", runtime.GOOS)
+	}
+
+	// The serial package silently caps the timeout outside of Windows
+	if c.ReadTimeout > maxPosixReadTimeout && runtime.GOOS != "windows" {
+		return nil, fmt.Errorf("read_timeout can be at most %s on %s, got %s", maxPosixReadTimeout, runtime.GOOS, c.ReadTimeout)
+	}
+
+	return &ttyReceiver{PortStr: rc.PortStr, Config: *c}, nil
+}
+
+func serialConfig(rc receiverConfig) (*serial.Config, error) {
+	c := &serial.Config{
+		Name:        rc.PortStr,
+		Baud:        rc.BaudRate,
+		Size:        serial.DefaultSize,
+		StopBits:    serial.Stop1,
+		ReadTimeout: rc.ReadTimeout,
+	}
+
+	if !baudRates[rc.BaudRate] {
+		return nil, fmt.Errorf("baud_rate %d is not supported", rc.BaudRate)
+	}
+
+	switch rc.DataBits {
+	case 0:
+	case 5, 6, 7, 8:
+		c.Size = byte(rc.DataBits)
+	default:
+		return nil, fmt.Errorf("data_bits must be between 5 and 8, got %d", rc.DataBits)
+	}
+
+	switch rc.StopBits {
+	case 0, 1:
+	case 2:
+		c.StopBits = serial.Stop2
+	default:
+		return nil, fmt.Errorf("stop_bits must be 1 or 2, got %d", rc.StopBits)
+	}
+
+	parity, ok := parities[rc.Parity]
+	if !ok {
+		return nil, fmt.Errorf("parity must be between 0 and 4, got %d", rc.Parity)
+	}
+
+	c.Parity = parity
+
+	if rc.ReadTimeout < 0 {
+		return nil, fmt.Errorf("read_timeout can not be negative, got %s", rc.ReadTimeout)
+	}
+
+	return c, nil
+}
+
+func (r *ttyReceiver) String() string {
+	return r.PortStr
+}
+
+// portName resolves a port pattern such as /dev/ttyUSB*, since the device
+// may come back under another name after it was unplugged
+func (r *ttyReceiver) portName() (string, error) {
+	matches, err := filepath.Glob(r.PortStr)
+	if err != nil {
+		return "", err
+	}
+
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no such device: %s", r.PortStr)
+	}
+
+	return matches[0], nil
+}
+
+func (r *ttyReceiver) Open() (io.ReadCloser, error) {
+	portStr, err := r.portName()
+	if err != nil {
+		return nil, err
+	}
+
+	c := r.Config
+	c.Name = portStr
+
+	return serial.OpenPort(&c)
+}